@@ -0,0 +1,323 @@
+// docker-unregstriy-untagger :- archive images before they are removed
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// formats of archiveFormat in rules.yml
+const (
+	archiveOCI    = "oci"
+	archiveDocker = "docker"
+)
+
+// ociRefName is the annotation of index.json holding the tag
+const ociRefName = "org.opencontainers.image.ref.name"
+
+// ociDescriptor is a descriptor of index.json with its annotations
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// dockerManifest is an entry of manifest.json in a docker save tarball
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// archiveSelected returns true if the image with tags has to be archived
+// before it is removed
+func archiveSelected(tags []string) bool {
+	if rules.ArchiveDir == "" {
+		return false
+	}
+	if len(rules.ArchiveTagsRegex) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		if validTag(rules.ArchiveTagsRegex, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveImage exports dgst with its tags to the archive directory of the
+// rules and returns the path and the archived size
+func archiveImage(ctx context.Context, b backend, repo string, dgst digest.Digest, tags []string) (string, int64, error) {
+	if rules.ArchiveFormat == archiveDocker {
+		return archiveDockerTarball(ctx, b, rules.ArchiveDir, repo, dgst, tags)
+	}
+	return archiveOCILayout(ctx, b, rules.ArchiveDir, repo, dgst, tags)
+}
+
+// copyVerified copies r to w and fails if the content does not match desc
+func copyVerified(w io.Writer, r io.Reader, desc descriptor) (int64, error) {
+	verifier := desc.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(w, verifier), r)
+	if err != nil {
+		return n, err
+	}
+	if desc.Size != 0 && n != desc.Size {
+		return n, fmt.Errorf("%s has %d bytes instead of %d", desc.Digest, n, desc.Size)
+	}
+	if !verifier.Verified() {
+		return n, fmt.Errorf("%s does not match its content", desc.Digest)
+	}
+	return n, nil
+}
+
+// writeVerified writes r to fileName if it matches desc. The file is written
+// to a temporary file first, so no partial blob is left behind.
+func writeVerified(fileName string, r io.Reader, desc descriptor) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), ".archive")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := copyVerified(tmp, r, desc)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), fileName)
+}
+
+// fetchVerifiedManifest downloads the manifest of dgst and checks its digest
+func fetchVerifiedManifest(ctx context.Context, b backend, repo string, dgst digest.Digest) ([]byte, imageManifest, error) {
+	payload, mediaType, err := b.Manifest(ctx, repo, dgst)
+	if err != nil {
+		return nil, imageManifest{}, err
+	}
+	if dgst.Algorithm().FromBytes(payload) != dgst {
+		return nil, imageManifest{}, fmt.Errorf("manifest %s does not match its content", dgst)
+	}
+	m, err := parseManifest(mediaType, payload)
+	if err != nil {
+		return nil, m, err
+	}
+	if len(m.FSLayers) != 0 {
+		return nil, m, fmt.Errorf("schema1 manifest %s cannot be archived", dgst)
+	}
+	return payload, m, nil
+}
+
+// ociBlobPath returns the path of a blob in an OCI image layout
+func ociBlobPath(layout string, dgst digest.Digest) string {
+	return filepath.Join(layout, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// archiveOCIBlob downloads a blob into the layout, blobs already archived by
+// an earlier image are not downloaded again
+func archiveOCIBlob(ctx context.Context, b backend, layout, repo string, desc descriptor) error {
+	fileName := ociBlobPath(layout, desc.Digest)
+	if _, err := os.Stat(fileName); err == nil {
+		return nil
+	}
+
+	reader, err := b.Blob(ctx, repo, desc.Digest)
+	if err != nil {
+		return fmt.Errorf("blob %s: %s", desc.Digest, err)
+	}
+	defer reader.Close()
+
+	_, err = writeVerified(fileName, reader, desc)
+	return err
+}
+
+// archiveOCIManifest stores a manifest, its config and layers or the
+// manifests of an index in the layout
+func archiveOCIManifest(ctx context.Context, b backend, layout, repo string, dgst digest.Digest) (ociDescriptor, int64, error) {
+	payload, m, err := fetchVerifiedManifest(ctx, b, repo, dgst)
+	if err != nil {
+		return ociDescriptor{}, 0, err
+	}
+
+	desc := ociDescriptor{MediaType: m.MediaType, Digest: dgst, Size: int64(len(payload))}
+	size := desc.Size
+	for _, child := range m.Manifests {
+		_, childSize, err := archiveOCIManifest(ctx, b, layout, repo, child.Digest)
+		if err != nil {
+			return desc, size, err
+		}
+		size += childSize
+	}
+	for _, blob := range m.blobs() {
+		if err := archiveOCIBlob(ctx, b, layout, repo, blob); err != nil {
+			return desc, size, err
+		}
+		size += blob.Size
+	}
+
+	// the manifest comes last, a manifest in the layout is always complete
+	_, err = writeVerified(ociBlobPath(layout, dgst), bytes.NewReader(payload), descriptor{Digest: dgst, Size: desc.Size})
+	return desc, size, err
+}
+
+// archiveOCILayout adds dgst to the OCI image layout of the repository below
+// dir and names it with its tags in index.json
+func archiveOCILayout(ctx context.Context, b backend, dir, repo string, dgst digest.Digest, tags []string) (string, int64, error) {
+	layout := filepath.Join(dir, filepath.FromSlash(repo))
+	desc, size, err := archiveOCIManifest(ctx, b, layout, repo, dgst)
+	if err != nil {
+		return layout, size, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return layout, size, err
+	}
+
+	indexFile := filepath.Join(layout, "index.json")
+	index := ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex}
+	if existing, err := ioutil.ReadFile(indexFile); err == nil {
+		if err := json.Unmarshal(existing, &index); err != nil {
+			return layout, size, fmt.Errorf("%s is malformed: %s", indexFile, err)
+		}
+	}
+	index.Manifests = addToIndex(index.Manifests, desc, tags)
+
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return layout, size, err
+	}
+	_, err = writeVerified(indexFile, bytes.NewReader(content), descriptor{Digest: digest.FromBytes(content)})
+	return layout, size, err
+}
+
+// addToIndex names desc with every tag, a tag archived before with another
+// digest is replaced
+func addToIndex(manifests []ociDescriptor, desc ociDescriptor, tags []string) []ociDescriptor {
+	names := make(map[string]bool)
+	for _, tag := range tags {
+		names[tag] = true
+	}
+
+	ret := make([]ociDescriptor, 0, len(manifests)+len(tags))
+	for _, m := range manifests {
+		if !names[m.Annotations[ociRefName]] {
+			ret = append(ret, m)
+		}
+	}
+	for _, tag := range tags {
+		named := desc
+		named.Annotations = map[string]string{ociRefName: tag}
+		ret = append(ret, named)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Annotations[ociRefName] < ret[j].Annotations[ociRefName] })
+	return ret
+}
+
+// archiveDockerTarball writes dgst as docker save tarball below dir. Layers
+// are stored as they come from the registry, docker load accepts compressed
+// layers.
+func archiveDockerTarball(ctx context.Context, b backend, dir, repo string, dgst digest.Digest, tags []string) (string, int64, error) {
+	fileName := filepath.Join(dir, filepath.FromSlash(repo), dgst.Algorithm().String()+"-"+dgst.Hex()+".tar")
+	_, m, err := fetchVerifiedManifest(ctx, b, repo, dgst)
+	if err != nil {
+		return fileName, 0, err
+	}
+	if m.Config == nil || isIndex(m.MediaType) {
+		return fileName, 0, fmt.Errorf("%s is no single image, only the oci format archives indexes", dgst)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return fileName, 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), ".archive")
+	if err != nil {
+		return fileName, 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := writeDockerTarball(ctx, b, tmp, repo, m, tags)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fileName, size, err
+	}
+	return fileName, size, os.Rename(tmp.Name(), fileName)
+}
+
+func writeDockerTarball(ctx context.Context, b backend, w io.Writer, repo string, m imageManifest, tags []string) (int64, error) {
+	tw := tar.NewWriter(w)
+
+	entry := dockerManifest{Config: m.Config.Digest.Hex() + ".json", RepoTags: make([]string, 0, len(tags))}
+	for _, tag := range tags {
+		entry.RepoTags = append(entry.RepoTags, repo+":"+tag)
+	}
+
+	size := int64(0)
+	add := func(name string, desc descriptor) error {
+		if desc.Size <= 0 {
+			return fmt.Errorf("blob %s has no size", desc.Digest)
+		}
+		reader, err := b.Blob(ctx, repo, desc.Digest)
+		if err != nil {
+			return fmt.Errorf("blob %s: %s", desc.Digest, err)
+		}
+		defer reader.Close()
+
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: desc.Size}); err != nil {
+			return err
+		}
+		n, err := copyVerified(tw, reader, desc)
+		size += n
+		return err
+	}
+
+	if err := add(entry.Config, *m.Config); err != nil {
+		return size, err
+	}
+	for _, layer := range m.Layers {
+		name := layer.Digest.Hex() + "/layer.tar"
+		if err := add(name, layer); err != nil {
+			return size, err
+		}
+		entry.Layers = append(entry.Layers, name)
+	}
+
+	content, err := json.Marshal([]dockerManifest{entry})
+	if err != nil {
+		return size, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(content))}); err != nil {
+		return size, err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return size, err
+	}
+	return size, tw.Close()
+}
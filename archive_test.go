@@ -0,0 +1,174 @@
+// docker-unregstriy-untagger :- tests for archives
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+// addArchiveImage adds an image with a config and one layer to f
+func addArchiveImage(f *fakeRegistry, repo, name string, created time.Time, tags ...string) (digest.Digest, digest.Digest, digest.Digest) {
+	config := []byte(`{"created":"` + created.Format(time.RFC3339) + `","name":"` + name + `"}`)
+	layer := []byte("layer of " + name)
+	configDigest := f.addBlob(repo, config)
+	layerDigest := f.addBlob(repo, layer)
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `",` +
+		`"config":{"mediaType":"` + schema2.MediaTypeImageConfig + `","digest":"` + configDigest.String() + `","size":` + strconv.Itoa(len(config)) + `},` +
+		`"layers":[{"mediaType":"` + schema2.MediaTypeLayer + `","digest":"` + layerDigest.String() + `","size":` + strconv.Itoa(len(layer)) + `}]}`)
+	return f.addManifest(repo, schema2.MediaTypeManifest, manifest, tags...), configDigest, layerDigest
+}
+
+func TestArchiveOCILayout(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	one, config, layer := addArchiveImage(f, "team/app", "one", time.Now(), "release_1", "build_1")
+	two, _, _ := addArchiveImage(f, "team/app", "two", time.Now(), "release_2")
+
+	layout, _, err := archiveOCILayout(context.Background(), &registryBackend{}, dir, "team/app", one, []string{"build_1", "release_1"})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "team", "app"), layout)
+	_, _, err = archiveOCILayout(context.Background(), &registryBackend{}, dir, "team/app", two, []string{"release_2"})
+	assert.NoError(t, err)
+
+	for _, d := range []digest.Digest{one, two, config, layer} {
+		_, err := os.Stat(ociBlobPath(layout, d))
+		assert.NoError(t, err, "blob "+d.String()+" should be archived")
+	}
+	_, err = os.Stat(filepath.Join(layout, "oci-layout"))
+	assert.NoError(t, err)
+
+	b, err := ioutil.ReadFile(filepath.Join(layout, "index.json"))
+	assert.NoError(t, err)
+	index := ociIndex{}
+	assert.NoError(t, json.Unmarshal(b, &index))
+	refs := make(map[string]digest.Digest)
+	for _, m := range index.Manifests {
+		refs[m.Annotations[ociRefName]] = m.Digest
+	}
+	assert.Equal(t, map[string]digest.Digest{"build_1": one, "release_1": one, "release_2": two}, refs)
+}
+
+func TestArchiveDockerTarball(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dgst, config, layer := addArchiveImage(f, "app", "one", time.Now(), "release_1")
+	fileName, _, err := archiveDockerTarball(context.Background(), &registryBackend{}, dir, "app", dgst, []string{"release_1"})
+	assert.NoError(t, err)
+
+	file, err := os.Open(fileName)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	entries := make(map[string][]byte)
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		entries[hdr.Name], _ = ioutil.ReadAll(tr)
+	}
+
+	manifests := []dockerManifest{}
+	assert.NoError(t, json.Unmarshal(entries["manifest.json"], &manifests))
+	assert.Equal(t, []dockerManifest{{
+		Config:   config.Hex() + ".json",
+		RepoTags: []string{"app:release_1"},
+		Layers:   []string{layer.Hex() + "/layer.tar"},
+	}}, manifests)
+	assert.Equal(t, config, digest.FromBytes(entries[config.Hex()+".json"]))
+	assert.Equal(t, layer, digest.FromBytes(entries[layer.Hex()+"/layer.tar"]))
+}
+
+func TestArchiveVerifiesDigests(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dgst, _, layer := addArchiveImage(f, "app", "one", time.Now(), "release_1")
+	f.repo("app").blobs[layer] = []byte("layer of ONE")
+
+	fileName, _, err := archiveDockerTarball(context.Background(), &registryBackend{}, dir, "app", dgst, []string{"release_1"})
+	assert.Error(t, err)
+	_, err = os.Stat(fileName)
+	assert.True(t, os.IsNotExist(err), "no tarball should be left")
+
+	layout, _, err := archiveOCILayout(context.Background(), &registryBackend{}, dir, "app", dgst, []string{"release_1"})
+	assert.Error(t, err)
+	_, err = os.Stat(ociBlobPath(layout, layer))
+	assert.True(t, os.IsNotExist(err), "no broken blob should be left")
+	_, err = os.Stat(ociBlobPath(layout, dgst))
+	assert.True(t, os.IsNotExist(err), "no incomplete manifest should be left")
+}
+
+func TestCleanRepositoryArchive(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldRules := rules
+	defer func() { rules = oldRules }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("(release|build)_([0-9]+)"),
+		KeepNewestBySort:   1,
+		ArchiveDir:         dir,
+		ArchiveFormat:      archiveOCI,
+		ArchiveTagsRegex:   []*regexp.Regexp{regexp.MustCompile("^release_")},
+	}
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	release1, _, _ := addArchiveImage(f, "app", "release 1", old, "release_1")
+	addArchiveImage(f, "app", "release 2", old, "release_2")
+	build1, _, _ := addArchiveImage(f, "app", "build 1", old, "build_1")
+	addArchiveImage(f, "app", "build 2", old, "build_2")
+
+	summary := &runSummary{}
+	_, _, err = cleanRepository(context.Background(), context.Background(), &registryBackend{}, "app", summary)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build_2", "release_2"}, f.tagsOf("app"))
+	assert.Equal(t, 1, summary.Archived)
+
+	// only the release is archived
+	_, err = os.Stat(ociBlobPath(filepath.Join(dir, "app"), release1))
+	assert.NoError(t, err)
+	_, err = os.Stat(ociBlobPath(filepath.Join(dir, "app"), build1))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,201 @@
+// docker-unregstriy-untagger :- registry backends
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// tagInfo is a tag with the metadata the backend lists along with it. Digest
+// and Created are empty if the backend only lists names.
+type tagInfo struct {
+	Name    string
+	Digest  digest.Digest
+	Created time.Time
+}
+
+// capabilities tell the rules what a backend can do
+type capabilities struct {
+	// TagDelete removes single tags, other tags of the digest stay
+	TagDelete bool
+	// PushTime lists the digest and push time with every tag, no manifest
+	// has to be downloaded and the minimum age counts from the push
+	PushTime bool
+	// Manifests serves manifests and blobs for backups, archives and size
+	// estimates
+	Manifests bool
+}
+
+// backend is everything the rules need from a registry product
+type backend interface {
+	Repositories(ctx context.Context) ([]string, error)
+	Tags(ctx context.Context, repo string) ([]tagInfo, error)
+	Digest(ctx context.Context, repo, tag string) (digest.Digest, error)
+	Metadata(ctx context.Context, repo, tag string) (imageMetadata, error)
+	DeleteTag(ctx context.Context, repo, tag string, dgst digest.Digest) error
+	DeleteDigest(ctx context.Context, repo string, dgst digest.Digest) error
+	// Referrers lists the manifests that have dgst as subject, e.g.
+	// signatures, they are removed together with their subject
+	Referrers(ctx context.Context, repo string, dgst digest.Digest) ([]digest.Digest, error)
+	// Manifest downloads a manifest with its media type, Blob a config or
+	// layer
+	Manifest(ctx context.Context, repo string, dgst digest.Digest) ([]byte, string, error)
+	Blob(ctx context.Context, repo string, dgst digest.Digest) (io.ReadCloser, error)
+	Capabilities() capabilities
+}
+
+// newBackend connects to the registry of the config. Only with probe the
+// registry is asked if it deletes single tags, the read-only commands never
+// delete and must not send the probe.
+func newBackend(ctx context.Context, probe bool) (backend, error) {
+	if cfg.Type == typeGitlab {
+		g, err := connectGitlab(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &gitlabBackend{client: g}, nil
+	}
+
+	var err error
+	hub, err = connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Type == typeHarbor {
+		return &harborBackend{}, nil
+	}
+	tagDelete, err := tagDeletion(ctx, probe)
+	if err != nil {
+		return nil, err
+	}
+	return &registryBackend{tagDelete: tagDelete}, nil
+}
+
+// how tags are removed, deleteMode in config.yml
+const (
+	deleteModeTag    = "tag"
+	deleteModeDigest = "digest"
+)
+
+// tagDeletion returns if the registry removes single tags. The filesystem
+// storage always does, a deleteMode in the config is used as it is, only
+// otherwise the registry is probed. Without probe the digest mode is assumed.
+func tagDeletion(ctx context.Context, probe bool) (bool, error) {
+	switch {
+	case storagePath != "":
+		return true, nil
+	case cfg.DeleteMode != "":
+		return cfg.DeleteMode == deleteModeTag, nil
+	case !probe:
+		return false, nil
+	}
+	return probeTagDeletion(ctx, rules.Repositories[0])
+}
+
+// deleteMode names how a backend removes tags for the summary
+func deleteMode(b backend) string {
+	if b.Capabilities().TagDelete {
+		return deleteModeTag
+	}
+	return deleteModeDigest
+}
+
+// registryBackend uses the docker registry API of hub, it is also used for
+// the filesystem storage
+type registryBackend struct {
+	tagDelete bool
+}
+
+func (r *registryBackend) Repositories(ctx context.Context) ([]string, error) {
+	return client(ctx).Repositories()
+}
+
+func (r *registryBackend) Tags(ctx context.Context, repo string) ([]tagInfo, error) {
+	tags, err := client(ctx).Tags(repo)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]tagInfo, 0, len(tags))
+	for _, tag := range tags {
+		infos = append(infos, tagInfo{Name: tag})
+	}
+	return infos, nil
+}
+
+func (r *registryBackend) Digest(ctx context.Context, repo, tag string) (digest.Digest, error) {
+	return manifestDigest(ctx, repo, tag)
+}
+
+func (r *registryBackend) Metadata(ctx context.Context, repo, tag string) (imageMetadata, error) {
+	return imageMetadataFor(ctx, repo, tag)
+}
+
+func (r *registryBackend) DeleteTag(ctx context.Context, repo, tag string, dgst digest.Digest) error {
+	return deleteTag(ctx, repo, tag)
+}
+
+func (r *registryBackend) DeleteDigest(ctx context.Context, repo string, dgst digest.Digest) error {
+	return client(ctx).DeleteManifest(repo, dgst)
+}
+
+func (r *registryBackend) Referrers(ctx context.Context, repo string, dgst digest.Digest) ([]digest.Digest, error) {
+	return getReferrers(ctx, repo, dgst)
+}
+
+func (r *registryBackend) Manifest(ctx context.Context, repo string, dgst digest.Digest) ([]byte, string, error) {
+	return getManifest(ctx, repo, dgst.String())
+}
+
+func (r *registryBackend) Blob(ctx context.Context, repo string, dgst digest.Digest) (io.ReadCloser, error) {
+	return client(ctx).DownloadLayer(repo, dgst)
+}
+
+func (r *registryBackend) Capabilities() capabilities {
+	return capabilities{TagDelete: r.tagDelete, Manifests: true}
+}
+
+// listedTags answers Digest and Metadata from the tag list if the backend
+// listed them and asks the backend otherwise
+type listedTags struct {
+	backend
+	tags map[string]tagInfo
+}
+
+func newListedTags(b backend, infos []tagInfo) *listedTags {
+	l := &listedTags{backend: b, tags: make(map[string]tagInfo)}
+	for _, info := range infos {
+		l.tags[info.Name] = info
+	}
+	return l
+}
+
+func (l *listedTags) Digest(ctx context.Context, repo, tag string) (digest.Digest, error) {
+	if info := l.tags[tag]; info.Digest != "" {
+		return info.Digest, nil
+	}
+	return l.backend.Digest(ctx, repo, tag)
+}
+
+func (l *listedTags) Metadata(ctx context.Context, repo, tag string) (imageMetadata, error) {
+	if info := l.tags[tag]; !info.Created.IsZero() {
+		return imageMetadata{Created: info.Created}, nil
+	}
+	return l.backend.Metadata(ctx, repo, tag)
+}
+
+func tagNames(infos []tagInfo) []string {
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	return names
+}
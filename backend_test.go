@@ -0,0 +1,263 @@
+// docker-unregstriy-untagger :- tests for the registry backends
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryBackend keeps the tags of all repositories in memory
+type memoryBackend struct {
+	sync.Mutex
+	tags      map[string]map[string]tagInfo
+	tagDelete bool
+	listed    bool
+	lookups   int
+	referrers map[digest.Digest][]digest.Digest
+	deleted   []digest.Digest
+	manifests map[digest.Digest]fakeManifest
+	blobs     map[digest.Digest][]byte
+}
+
+func newMemoryBackend(tagDelete, listed bool) *memoryBackend {
+	return &memoryBackend{
+		tags:      make(map[string]map[string]tagInfo),
+		tagDelete: tagDelete,
+		listed:    listed,
+		manifests: make(map[digest.Digest]fakeManifest),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+}
+
+func (m *memoryBackend) addBlob(content []byte) descriptor {
+	d := digest.FromBytes(content)
+	m.blobs[d] = content
+	return descriptor{MediaType: "application/octet-stream", Digest: d, Size: int64(len(content))}
+}
+
+// addImage stores an OCI manifest with a config and layers and tags it
+func (m *memoryBackend) addImage(repo, tag string, created time.Time, layers ...string) digest.Digest {
+	config := m.addBlob([]byte(`{"created":"` + created.Format(time.RFC3339) + `"}`))
+	descs := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		desc := m.addBlob([]byte(layer))
+		descs = append(descs, fmt.Sprintf(`{"mediaType":"%s","digest":"%s","size":%d}`, desc.MediaType, desc.Digest, desc.Size))
+	}
+	payload := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"%s","digest":"%s","size":%d},"layers":[%s]}`,
+		mediaTypeOCIManifest, config.MediaType, config.Digest, config.Size, strings.Join(descs, ",")))
+	d := digest.FromBytes(payload)
+	m.manifests[d] = fakeManifest{mediaType: mediaTypeOCIManifest, payload: payload}
+	m.add(repo, tag, d, created)
+	return d
+}
+
+func (m *memoryBackend) add(repo, tag string, dgst digest.Digest, created time.Time) {
+	if m.tags[repo] == nil {
+		m.tags[repo] = make(map[string]tagInfo)
+	}
+	m.tags[repo][tag] = tagInfo{Name: tag, Digest: dgst, Created: created}
+}
+
+func (m *memoryBackend) names(repo string) []string {
+	m.Lock()
+	defer m.Unlock()
+	ret := make([]string, 0)
+	for tag := range m.tags[repo] {
+		ret = append(ret, tag)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (m *memoryBackend) Repositories(ctx context.Context) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	ret := make([]string, 0)
+	for repo := range m.tags {
+		ret = append(ret, repo)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (m *memoryBackend) Tags(ctx context.Context, repo string) ([]tagInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	ret := make([]tagInfo, 0)
+	for _, info := range m.tags[repo] {
+		if !m.listed {
+			info = tagInfo{Name: info.Name}
+		}
+		ret = append(ret, info)
+	}
+	return ret, nil
+}
+
+func (m *memoryBackend) lookup(repo, tag string) (tagInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.lookups++
+	info, ok := m.tags[repo][tag]
+	if !ok {
+		return info, fmt.Errorf("tag %s not found", tag)
+	}
+	return info, nil
+}
+
+func (m *memoryBackend) Digest(ctx context.Context, repo, tag string) (digest.Digest, error) {
+	info, err := m.lookup(repo, tag)
+	return info.Digest, err
+}
+
+func (m *memoryBackend) Metadata(ctx context.Context, repo, tag string) (imageMetadata, error) {
+	info, err := m.lookup(repo, tag)
+	return imageMetadata{Created: info.Created}, err
+}
+
+func (m *memoryBackend) DeleteTag(ctx context.Context, repo, tag string, dgst digest.Digest) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.tags[repo], tag)
+	return nil
+}
+
+func (m *memoryBackend) DeleteDigest(ctx context.Context, repo string, dgst digest.Digest) error {
+	m.Lock()
+	defer m.Unlock()
+	m.deleted = append(m.deleted, dgst)
+	for tag, info := range m.tags[repo] {
+		if info.Digest == dgst {
+			delete(m.tags[repo], tag)
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) Referrers(ctx context.Context, repo string, dgst digest.Digest) ([]digest.Digest, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.referrers[dgst], nil
+}
+
+func (m *memoryBackend) Manifest(ctx context.Context, repo string, dgst digest.Digest) ([]byte, string, error) {
+	m.Lock()
+	defer m.Unlock()
+	manifest, ok := m.manifests[dgst]
+	if !ok {
+		return nil, "", fmt.Errorf("manifest %s not found", dgst)
+	}
+	return manifest.payload, manifest.mediaType, nil
+}
+
+func (m *memoryBackend) Blob(ctx context.Context, repo string, dgst digest.Digest) (io.ReadCloser, error) {
+	m.Lock()
+	defer m.Unlock()
+	blob, ok := m.blobs[dgst]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", dgst)
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob)), nil
+}
+
+func (m *memoryBackend) Capabilities() capabilities {
+	return capabilities{TagDelete: m.tagDelete, PushTime: m.listed, Manifests: true}
+}
+
+func TestCleanRepositoryBackends(t *testing.T) {
+	oldRules := rules
+	defer func() { rules = oldRules }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+		MinAge:             7,
+	}
+
+	var tests = []struct {
+		tagDelete bool
+		listed    bool
+		kept      []string
+		mode      string
+	}{
+		// build_1 shares its digest with release_1 and is only removed by tag
+		{false, false, []string{"build_1", "build_2", "build_4", "release_1"}, "digest"},
+		{true, false, []string{"build_2", "build_4", "release_1"}, "tag"},
+		{true, true, []string{"build_2", "build_4", "release_1"}, "tag"},
+	}
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	for i, tt := range tests {
+		b := newMemoryBackend(tt.tagDelete, tt.listed)
+		b.add("app", "build_1", digest.FromString("1"), old)
+		b.add("app", "release_1", digest.FromString("1"), old)
+		b.add("app", "build_2", digest.FromString("2"), time.Now())
+		b.add("app", "build_3", digest.FromString("3"), old)
+		b.add("app", "build_4", digest.FromString("4"), old)
+
+		_, _, err := cleanRepository(context.Background(), context.Background(), b, "app", &runSummary{})
+		assert.NoError(t, err)
+		assert.Equal(t, tt.kept, b.names("app"), "TestCleanRepositoryBackends "+strconv.Itoa(i+1)+" values should be equal")
+		assert.Equal(t, tt.mode, deleteMode(b), "TestCleanRepositoryBackends "+strconv.Itoa(i+1)+" values should be equal")
+		if tt.listed {
+			assert.Equal(t, 0, b.lookups, "listed tags need no lookups")
+		}
+	}
+}
+
+func TestCleanRepositoryManifestsFromBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldRules, oldHub, oldRunDir, oldEstimate, oldDryRun := rules, hub, runDir, estimate, dryRun
+	defer func() { rules, hub, runDir, estimate, dryRun = oldRules, oldHub, oldRunDir, oldEstimate, oldDryRun }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+		ArchiveDir:         filepath.Join(dir, "archive"),
+		ArchiveFormat:      archiveOCI,
+	}
+	// no registry, everything is read from the backend
+	hub = nil
+	runDir = filepath.Join(dir, "backup")
+	estimate, dryRun = true, false
+
+	created := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	b := newMemoryBackend(false, true)
+	old := b.addImage("app", "build_1", created, "base", "old layer")
+	b.addImage("app", "build_2", created.Add(time.Hour), "base", "new layer")
+
+	summary := &runSummary{}
+	removed, _, err := cleanRepository(context.Background(), context.Background(), b, "app", summary)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, []string{"build_2"}, b.names("app"))
+	// the config and the layer only build_1 uses
+	assert.Equal(t, int64(len(`{"created":"2017-03-01T00:00:00Z"}`)+len("old layer")), summary.Reclaimable)
+
+	_, err = os.Stat(backupFileName(runDir, "app", old))
+	assert.NoError(t, err, "backup should be written")
+	_, err = os.Stat(filepath.Join(rules.ArchiveDir, "app", "index.json"))
+	assert.NoError(t, err, "archive should be written")
+}
@@ -0,0 +1,101 @@
+// docker-unregstriy-untagger :- manifest backups
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// backupEntry is everything needed to push a removed manifest again
+type backupEntry struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	MediaType  string        `json:"mediaType"`
+	Tags       []string      `json:"tags"`
+	Manifest   []byte        `json:"manifest"`
+	Removed    time.Time     `json:"removed"`
+}
+
+// backupFileName returns the path of the backup for a digest in a run directory
+func backupFileName(runDir, repo string, dgst digest.Digest) string {
+	return filepath.Join(runDir, filepath.FromSlash(repo), dgst.Algorithm().String()+"-"+dgst.Hex()+".json")
+}
+
+// groupTagsByDigest maps every digest to all tags that point to it
+func groupTagsByDigest(tags []string, digests []digest.Digest) map[digest.Digest][]string {
+	ret := make(map[digest.Digest][]string)
+	for i := range digests {
+		ret[digests[i]] = append(ret[digests[i]], tags[i])
+	}
+	for d := range ret {
+		sort.Strings(ret[d])
+	}
+	return ret
+}
+
+// backupManifest stores the manifest of dgst and its tags in runDir
+func backupManifest(ctx context.Context, b backend, runDir, repo string, dgst digest.Digest, tags []string) error {
+	payload, mediaType, err := b.Manifest(ctx, repo, dgst)
+	if err != nil {
+		return err
+	}
+
+	entry := backupEntry{
+		Repository: repo,
+		Digest:     dgst,
+		MediaType:  mediaType,
+		Tags:       tags,
+		Manifest:   payload,
+		Removed:    time.Now().UTC(),
+	}
+
+	content, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fileName := backupFileName(runDir, repo, dgst)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, content, 0644)
+}
+
+// loadBackup reads a single backup file or all backups below a run directory
+func loadBackup(path string) ([]backupEntry, error) {
+	entries := make([]backupEntry, 0)
+	err := filepath.Walk(path, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(fileName, ".json") {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+
+		entry := backupEntry{}
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,110 @@
+// docker-unregstriy-untagger :- tests for manifest backups
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupTagsByDigest(t *testing.T) {
+	var tests = []struct {
+		inTags    []string
+		inDigests []digest.Digest
+		out       map[digest.Digest][]string
+	}{
+		{
+			[]string{"b_2", "a_1", "c_3"},
+			[]digest.Digest{"sha256:aa", "sha256:aa", "sha256:cc"},
+			map[digest.Digest][]string{"sha256:aa": {"a_1", "b_2"}, "sha256:cc": {"c_3"}},
+		}, {
+			[]string{},
+			[]digest.Digest{},
+			map[digest.Digest][]string{},
+		},
+	}
+
+	for i, tt := range tests {
+		b := groupTagsByDigest(tt.inTags, tt.inDigests)
+		assert.Equal(t, tt.out, b, "TestGroupTagsByDigest "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestBackupManifest(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	payload := []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `"}`)
+	d := f.addManifest("team/app", schema2.MediaTypeManifest, payload, "build_1", "build_2")
+
+	dir, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, backupManifest(context.Background(), &registryBackend{}, dir, "team/app", d, []string{"build_1", "build_2"}))
+
+	entries, err := loadBackup(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "team/app", entries[0].Repository)
+	assert.Equal(t, d, entries[0].Digest)
+	assert.Equal(t, schema2.MediaTypeManifest, entries[0].MediaType)
+	assert.Equal(t, []string{"build_1", "build_2"}, entries[0].Tags)
+	assert.Equal(t, payload, entries[0].Manifest)
+
+	entries, err = loadBackup(backupFileName(dir, "team/app", d))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestCleanRepositoryBackupReferrers(t *testing.T) {
+	oldRules, oldDryRun, oldRunDir := rules, dryRun, runDir
+	defer func() { rules, dryRun, runDir = oldRules, oldDryRun, oldRunDir }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+	}
+	dryRun = false
+
+	dir, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	runDir = dir
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	b := newMemoryBackend(false, true)
+	one := b.addImage("app", "build_1", old, "layer 1")
+	b.addImage("app", "build_2", old, "layer 2")
+	signature := []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `","subject":{"digest":"` + one.String() + `"}}`)
+	referrer := digest.FromBytes(signature)
+	b.manifests[referrer] = fakeManifest{mediaType: mediaTypeOCIManifest, payload: signature}
+	b.referrers = map[digest.Digest][]digest.Digest{one: {referrer}}
+
+	_, _, err = cleanRepository(context.Background(), context.Background(), b, "app", &runSummary{})
+	assert.NoError(t, err)
+	assert.Contains(t, b.deleted, referrer)
+
+	// the referrer is restored by digest, it has no tags
+	entries, err := loadBackup(dir)
+	assert.NoError(t, err)
+	tags := make(map[digest.Digest][]string)
+	for _, entry := range entries {
+		tags[entry.Digest] = entry.Tags
+	}
+	assert.Equal(t, map[digest.Digest][]string{one: {"build_1"}, referrer: nil}, tags)
+}
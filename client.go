@@ -0,0 +1,164 @@
+// docker-unregstriy-untagger :- registry client
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/wind0r/docker-registry-client/registry"
+)
+
+// hostTransport returns the transport for requests against url with the
+// rate limit of its host and the metrics at the bottom
+func hostTransport(url string) (http.RoundTripper, error) {
+	host, err := neturl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	tlsConfig, err := registryTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport = t
+	}
+	transport = &metricsTransport{registry: registryLabel(), Transport: transport}
+	return &limitTransport{
+		host:      host.Host,
+		limiter:   limiterFor(host.Host, cfg.RequestsPerSecond, cfg.MaxConcurrentRequests),
+		Transport: transport,
+	}, nil
+}
+
+// registryTLSConfig returns the TLS settings of the registry in cfg or nil
+// for the defaults: a CA bundle in addition to the system certificates, a
+// client certificate and skipping the verification with insecure
+func registryTLSConfig() (*tls.Config, error) {
+	skipVerify := insecure || cfg.Insecure
+	if !skipVerify && cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" {
+		return nil, nil
+	}
+
+	c := &tls.Config{InsecureSkipVerify: skipVerify}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("caFile: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("caFile %s contains no certificate", cfg.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %s", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// registryLabel names the registry in cfg for the metrics
+func registryLabel() string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return cfg.Host
+}
+
+// connect creates a new registry client, like registry.New but with the
+// rate limit and metrics transports at the bottom of the transport chain
+func connect(ctx context.Context) (*registry.Registry, error) {
+	if storagePath != "" {
+		return connectStorage(storagePath), nil
+	}
+
+	url := strings.TrimSuffix(cfg.Host, "/")
+	transport, err := hostTransport(url)
+	if err != nil {
+		return nil, err
+	}
+
+	hub := &registry.Registry{
+		URL: url,
+		Client: &http.Client{
+			Transport: registry.WrapTransport(transport, url, cfg.User, cfg.Password),
+		},
+		Logf: registry.Quiet,
+	}
+
+	if err := ping(ctx, hub); err != nil {
+		return nil, err
+	}
+	return hub, nil
+}
+
+// connectStorage creates a registry client that reads filesystem storage
+// instead of talking to a registry
+func connectStorage(path string) *registry.Registry {
+	url := "http://storage"
+	return &registry.Registry{
+		URL: url,
+		Client: &http.Client{
+			Transport: registry.WrapTransport(&storageTransport{storage: newStorage(path)}, url, "", ""),
+		},
+		Logf: registry.Quiet,
+	}
+}
+
+// ping is registry.Ping with a context
+func ping(ctx context.Context, r *registry.Registry) error {
+	req, err := http.NewRequest("GET", r.URL+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.Client.Do(req.WithContext(ctx))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
+
+// contextTransport attaches a context to every request, the vendored client
+// creates its requests without one
+type contextTransport struct {
+	ctx       context.Context
+	Transport http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.Transport.RoundTrip(req.WithContext(t.ctx))
+}
+
+// client returns hub with all of its requests bound to ctx
+func client(ctx context.Context) *registry.Registry {
+	return &registry.Registry{
+		URL: hub.URL,
+		Client: &http.Client{
+			Transport: &contextTransport{ctx: ctx, Transport: hub.Client.Transport},
+		},
+		Logf: hub.Logf,
+	}
+}
@@ -0,0 +1,611 @@
+// docker-unregstriy-untagger :- subcommands
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// version is set when building, e.g. -ldflags "-X main.version=1.2.0"
+var version = "dev"
+
+// command is a subcommand with its own flags
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+func commandList() []command {
+	return []command{
+		{"plan", "show which tags the rules remove without removing them", planCommand},
+		{"apply", "remove the tags the rules do not keep", applyCommand},
+		{"list", "list the tags of repositories with their digest and creation time", listCommand},
+		{"explain", "explain for every tag of a repository why it is kept or removed", explainCommand},
+		{"simulate", "evaluate the rules against a tag list without a registry", simulateCommand},
+		{"validate", "check the config and lint the rules", validateCommand},
+		{"stats", "summarize the tags, sizes and expiring tags of the repositories", statsCommand},
+		{"restore", "push the removed tags of a backup again", restoreCommand},
+		{"gc", "list or remove the blobs of a filesystem storage no manifest references", gcCommand},
+		{"version", "print the version", versionCommand},
+	}
+}
+
+// runCommand runs the subcommand named by the first argument and returns the
+// exit code
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return exitUsage
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		usage(os.Stdout)
+		return exitSuccess
+	}
+
+	for _, c := range commandList() {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	usage(os.Stderr)
+	return exitUsage
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: docker-registry-untagger <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range commandList() {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.description)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run docker-registry-untagger <command> -h for the flags of a command.")
+}
+
+// newFlagSet creates the flags of a command, args describes the arguments
+// after the flags
+func newFlagSet(name, args, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: docker-registry-untagger %s [flags] %s\n\n%s\n\nFlags:\n", name, args, description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags returns the exit code if the command must not go on
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return exitSuccess, false
+	}
+	if err != nil {
+		return exitUsage, false
+	}
+	return 0, true
+}
+
+// configFlags are the flags of every command that reads the config
+type configFlags struct {
+	config string
+	rules  string
+}
+
+func (c *configFlags) add(fs *flag.FlagSet) {
+	fs.StringVar(&c.config, "config", "config.yml", "the config file")
+	fs.StringVar(&c.rules, "rules", "rules.yml", "the rule file")
+	fs.BoolVar(&insecure, "insecure", false, "allowe insecure connection to the docker registry")
+}
+
+func (c *configFlags) load() bool {
+	if err := loadConfig(c.config, c.rules); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return false
+	}
+	return true
+}
+
+// addRunFlags adds the flags plan and apply share
+func addRunFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&fullScan, "full", false, "evaluate all repositories even if they did not change since the last run")
+	fs.BoolVar(&estimate, "estimate", false, "estimate the space the garbage-collector can free after the run")
+	fs.BoolVar(&registryScan, "registryScan", false, "scan all repositories of the registry for the space that is really freed and the most shared blobs")
+}
+
+func planCommand(args []string) int {
+	var c configFlags
+	fs := newFlagSet("plan", "", "Evaluates the rules for every repository and prints the tags that apply would remove.")
+	c.add(fs)
+	addRunFlags(fs)
+	fs.StringVar(&storagePath, "storage", "", "read the filesystem storage of a registry below this path instead of connecting to host")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	dryRun = true
+	if !c.load() {
+		return exitConfig
+	}
+	if err := checkStorage(); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitConfig
+	}
+	return cleanup(nil)
+}
+
+func applyCommand(args []string) int {
+	var c configFlags
+	fs := newFlagSet("apply", "", "Removes the tags the rules do not keep from every repository.")
+	c.add(fs)
+	addRunFlags(fs)
+	fs.StringVar(&storagePath, "storage", "", "remove single tags from the filesystem storage of a registry below this path, manifests stay as long as another tag points to them")
+	daemon := fs.Bool("daemon", false, "keep running and clean up on the schedule of the config file")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	dryRun = false
+	if !c.load() {
+		return exitConfig
+	}
+	if err := checkStorage(); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitConfig
+	}
+
+	var schedule *cronSchedule
+	if *daemon {
+		var err error
+		schedule, err = parseCron(cfg.Schedule)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: schedule is malformed: ", err)
+			return exitConfig
+		}
+		if schedule.next(time.Now()).IsZero() {
+			fmt.Fprintf(os.Stderr, "ERROR: schedule %q never runs\n", cfg.Schedule)
+			return exitConfig
+		}
+	}
+	return cleanup(schedule)
+}
+
+// cleanup runs the rules once or on schedule and returns the exit code
+func cleanup(schedule *cronSchedule) int {
+	timeout := defaultShutdownTimeout
+	if cfg.ShutdownTimeout > 0 {
+		timeout = time.Duration(cfg.ShutdownTimeout) * time.Second
+	}
+	stopping, ctx := shutdownContexts(timeout)
+
+	if cfg.MetricsListen != "" {
+		serveMetrics(cfg.MetricsListen)
+	}
+
+	if schedule != nil {
+		runDaemon(ctx, stopping, schedule, time.Duration(cfg.ScheduleJitter)*time.Second)
+		return exitSuccess
+	}
+
+	summary, err := run(ctx, stopping)
+	if cfg.MetricsTextfile != "" {
+		if err := writeMetricsFile(cfg.MetricsTextfile); err != nil {
+			fmt.Println("ERROR: ", err)
+		}
+	}
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		return exitFailure
+	}
+
+	fmt.Println("Summary: ", summary)
+	return summary.exitCode()
+}
+
+// targetFlags select one registry of the config for the commands that read
+// a single registry
+type targetFlags struct {
+	configFlags
+	registry string
+}
+
+func (t *targetFlags) add(fs *flag.FlagSet) {
+	t.configFlags.add(fs)
+	fs.StringVar(&t.registry, "registry", "", "the registry of config.yml if there are several")
+	fs.StringVar(&storagePath, "storage", "", "read the filesystem storage of a registry below this path instead of connecting to host")
+}
+
+// connect loads the config and returns the backend of the selected registry
+func (t *targetFlags) connect(ctx context.Context) (backend, bool) {
+	dryRun = true
+	if !t.load() {
+		return nil, false
+	}
+	target, err := targetNamed(t.registry)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return nil, false
+	}
+	use(target)
+
+	b, err := newBackend(ctx, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return nil, false
+	}
+	return b, true
+}
+
+// repositories returns the repositories given as arguments or all
+// repositories of the rules
+func repositories(args []string) []string {
+	if len(args) != 0 {
+		return args
+	}
+	return rules.Repositories
+}
+
+func listCommand(args []string) int {
+	var t targetFlags
+	fs := newFlagSet("list", "[repository...]", "Lists the tags of the repositories with their digest and creation time, all repositories of the rules without arguments.")
+	t.add(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	ctx := context.Background()
+	b, ok := t.connect(ctx)
+	if !ok {
+		return exitConfig
+	}
+
+	failed := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, repo := range repositories(fs.Args()) {
+		if err := listRepository(ctx, tw, b, repo); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: ", repo, err)
+			failed++
+		}
+	}
+	tw.Flush()
+	if failed != 0 {
+		return exitPartialFailure
+	}
+	return exitSuccess
+}
+
+func listRepository(ctx context.Context, w io.Writer, b backend, repo string) error {
+	infos, err := b.Tags(ctx, repo)
+	if err != nil {
+		return err
+	}
+	b = newListedTags(b, infos)
+
+	tags := tagNames(infos)
+	sort.Strings(tags)
+	for _, tag := range tags {
+		dgst, err := b.Digest(ctx, repo, tag)
+		if err != nil {
+			return err
+		}
+		m, err := b.Metadata(ctx, repo, tag)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s:%s\t%s\t%s\n", repo, tag, dgst, m.Created.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func explainCommand(args []string) int {
+	var t targetFlags
+	fs := newFlagSet("explain", "repository [tag...]", "Explains for every tag of the repository, or only the given tags, why the rules keep or remove it.")
+	t.add(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	ctx := context.Background()
+	b, ok := t.connect(ctx)
+	if !ok {
+		return exitConfig
+	}
+
+	decisions, err := explainRepository(ctx, b, fs.Arg(0), time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", fs.Arg(0), err)
+		return exitFailure
+	}
+
+	only := make(map[string]bool)
+	for _, tag := range fs.Args()[1:] {
+		only[tag] = true
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, d := range decisions {
+		if len(only) != 0 && !only[d.Tag] {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Tag, d.action(), d.Reason)
+	}
+	tw.Flush()
+	return exitSuccess
+}
+
+func simulateCommand(args []string) int {
+	fs := newFlagSet("simulate", "[tag list]", "Evaluates the rules against a tag list read from a file or stdin and prints for every tag if it is kept or removed and why. The list has one tag per line, CSV or JSON with creation time and digest.")
+	rulesFileName := fs.String("rules", "rules.yml", "the rule file")
+	format := fs.String("format", "", "format of the tag list: plain, csv or json (default guessed from the file)")
+	repo := fs.String("repository", "simulated", "the repository name for the rules")
+	now := fs.String("now", "", "evaluate the minimum age at this time (RFC 3339) instead of now, for reproducible golden files")
+	tagDelete := fs.Bool("tagDelete", false, "simulate a registry that removes single tags instead of digests")
+	golden := fs.String("golden", "", "compare the result with this file and fail on differences")
+	update := fs.Bool("update", false, "write the result to the -golden file instead of comparing")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 1 || (*update && *golden == "") {
+		fs.Usage()
+		return exitUsage
+	}
+
+	r, hash, err := loadRules(*rulesFileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitConfig
+	}
+	// there is no config, the tag list needs one lookup at a time
+	use(&target{cfg: config{PoolSize: 1, ParallelDownloads: 1}, rules: r, rulesHash: hash})
+
+	at := time.Now()
+	if *now != "" {
+		at, err = time.Parse(time.RFC3339, *now)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: -now: ", err)
+			return exitUsage
+		}
+	}
+
+	input := "-"
+	if fs.NArg() == 1 {
+		input = fs.Arg(0)
+	}
+	content, err := readInput(input, os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitFailure
+	}
+	if *format == "" {
+		*format = tagListFormat(input, content)
+	}
+
+	decisions, err := simulate(content, *format, *repo, *tagDelete, at)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitFailure
+	}
+	result := formatDecisions(decisions)
+
+	switch {
+	case *update:
+		if err := ioutil.WriteFile(*golden, result, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: ", err)
+			return exitFailure
+		}
+		fmt.Println("Updated ", *golden)
+	case *golden != "":
+		expected, err := ioutil.ReadFile(*golden)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: ", err)
+			return exitFailure
+		}
+		diff := diffDecisions(expected, result)
+		for _, line := range diff {
+			fmt.Println(line)
+		}
+		if len(diff) != 0 {
+			fmt.Printf("%d lines differ from %s\n", len(diff), *golden)
+			return exitPartialFailure
+		}
+	default:
+		os.Stdout.Write(result)
+	}
+	return exitSuccess
+}
+
+func validateCommand(args []string) int {
+	var c configFlags
+	fs := newFlagSet("validate", "", "Reads the config and lints the rules of every registry. Every problem is reported with its file and line.")
+	c.add(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	base, err := readConfig(c.config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitConfig
+	}
+	configs, rulesFiles, err := registryTargets(base, c.rules)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR:  config file %s is malformed: %s\n", c.config, err)
+		return exitConfig
+	}
+
+	failed := false
+	// every rules file is linted once, even if several registries share it
+	issues := make(map[string]int)
+	for i := range configs {
+		if _, ok := issues[rulesFiles[i]]; !ok {
+			found, err := lintRulesFile(rulesFiles[i])
+			if err != nil {
+				fmt.Println(err)
+				failed = true
+				continue
+			}
+			for _, issue := range found {
+				fmt.Println(issue)
+			}
+			issues[rulesFiles[i]] = len(found)
+		}
+
+		t, err := loadTarget(configs[i], rulesFiles[i])
+		if issues[rulesFiles[i]] != 0 {
+			// the lint already reported what is wrong with the rules
+			failed = true
+			continue
+		}
+		if err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+		name := t.name
+		if name == "" {
+			name = t.cfg.Host
+		}
+		fmt.Printf("%s: %d repositories, %d valid tag regexes\n", name, len(t.rules.Repositories), len(t.rules.ValidTagsRegex))
+	}
+	if failed {
+		return exitConfig
+	}
+	return exitSuccess
+}
+
+func statsCommand(args []string) int {
+	var t targetFlags
+	fs := newFlagSet("stats", "[repository...]", "Prints tags, flavors, builds, digests, sizes and expiring tags of the repositories, all repositories of the rules without arguments.")
+	t.add(fs)
+	all := fs.Bool("all", false, "all repositories of the registry, also those without rules")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	ctx := context.Background()
+	b, ok := t.connect(ctx)
+	if !ok {
+		return exitConfig
+	}
+	repos, configured, err := statsRepositories(ctx, b, fs.Args(), *all)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitFailure
+	}
+
+	failed := 0
+	stats := make([]repositoryStats, 0, len(repos))
+	now := time.Now()
+	for _, repo := range repos {
+		s, err := collectStats(ctx, b, repo, configured[repo], now)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: ", repo, err)
+			failed++
+			continue
+		}
+		stats = append(stats, s)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(stats); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: ", err)
+			return exitFailure
+		}
+	} else {
+		printStatsTable(os.Stdout, stats)
+	}
+	if failed != 0 {
+		return exitPartialFailure
+	}
+	return exitSuccess
+}
+
+func restoreCommand(args []string) int {
+	var c configFlags
+	fs := newFlagSet("restore", "backup", "Pushes the manifests of a backup directory or file again and restores their tags.")
+	c.add(fs)
+	onlyDigest := fs.String("digest", "", "only restore this digest from the backup")
+	registryName := fs.String("registry", "", "the registry of config.yml to restore into if there are several")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if !c.load() {
+		return exitConfig
+	}
+	t, err := targetNamed(*registryName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitConfig
+	}
+	if t.cfg.Type == typeGitlab {
+		fmt.Fprintln(os.Stderr, "ERROR: restore is not supported for gitlab")
+		return exitConfig
+	}
+	use(t)
+
+	ctx := context.Background()
+	hub, err = connect(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitFailure
+	}
+	if restoreBackup(ctx, fs.Arg(0), *onlyDigest) != 0 {
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+func gcCommand(args []string) int {
+	fs := newFlagSet("gc", "", "Lists the blobs of a filesystem storage that no manifest references and removes them with -confirm.")
+	path := fs.String("storage", "", "the filesystem storage of a registry")
+	confirm := fs.Bool("confirm", false, "remove the listed blobs")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *path == "" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if err := garbageCollect(*path, *confirm); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: ", err)
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+func versionCommand(args []string) int {
+	fs := newFlagSet("version", "", "Prints the version.")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	fmt.Println("docker-registry-untagger", version)
+	return exitSuccess
+}
@@ -0,0 +1,70 @@
+// docker-unregstriy-untagger :- tests for the subcommands
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCommand(t *testing.T) {
+	oldTargets, oldCfg := targets, cfg
+	defer func() {
+		targets, cfg, storagePath = oldTargets, oldCfg, ""
+		use(targets[0])
+	}()
+
+	dir, err := ioutil.TempDir("", "commands")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.yml")
+	rulesFile := filepath.Join(dir, "rules.yml")
+	brokenRulesFile := filepath.Join(dir, "broken.yml")
+	lintRulesFile := filepath.Join(dir, "lint.yml")
+	neverConfigFile := filepath.Join(dir, "never.yml")
+	registriesConfigFile := filepath.Join(dir, "registries.yml")
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte("host: http://localhost:5000\npoolSize: 1\nparallelDownloads: 1\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(neverConfigFile, []byte("host: http://localhost:5000\npoolSize: 1\nparallelDownloads: 1\nschedule: 0 0 30 2 *\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(registriesConfigFile, []byte("poolSize: 1\nparallelDownloads: 1\nregistries:\n  - name: eu\n    host: http://localhost:5000\n  - name: us\n    host: http://localhost:5001\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(rulesFile, []byte("repositories: [app]\nvalidTags: ['^build_[0-9]+$']\nbuildSortRegex: build_([0-9]+)\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(brokenRulesFile, []byte("repositories: [app]\nvalidTags: ['^build_[0-9+$']\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(lintRulesFile, []byte("repositories: [app]\nvalidTags: ['^build_[0-9]+$']\nkeepBuilds: -1\n"), 0644))
+
+	var tests = []struct {
+		args []string
+		code int
+	}{
+		{[]string{}, exitUsage},
+		{[]string{"help"}, exitSuccess},
+		{[]string{"unknown"}, exitUsage},
+		{[]string{"version"}, exitSuccess},
+		{[]string{"version", "-unknown"}, exitUsage},
+		{[]string{"validate", "-h"}, exitSuccess},
+		{[]string{"validate", "-config", configFile, "-rules", rulesFile}, exitSuccess},
+		{[]string{"validate", "-config", configFile, "-rules", brokenRulesFile}, exitConfig},
+		{[]string{"validate", "-config", configFile, "-rules", lintRulesFile}, exitConfig},
+		{[]string{"validate", "-config", filepath.Join(dir, "missing.yml"), "-rules", rulesFile}, exitConfig},
+		{[]string{"explain", "-config", configFile, "-rules", rulesFile}, exitUsage},
+		{[]string{"restore", "-config", configFile, "-rules", rulesFile}, exitUsage},
+		{[]string{"gc"}, exitUsage},
+		// the 30th of february never comes
+		{[]string{"apply", "-daemon", "-config", neverConfigFile, "-rules", rulesFile}, exitConfig},
+		// one storage cannot hold several registries
+		{[]string{"plan", "-config", registriesConfigFile, "-rules", rulesFile, "-storage", dir}, exitConfig},
+		{[]string{"apply", "-config", registriesConfigFile, "-rules", rulesFile, "-storage", dir}, exitConfig},
+	}
+
+	for i, tt := range tests {
+		assert.Equal(t, tt.code, runCommand(tt.args), "TestRunCommand "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
@@ -0,0 +1,115 @@
+// docker-unregstriy-untagger :- signatures, attestations and SBOMs
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// subjectTagRegex matches the tags cosign pushes for a subject digest, e.g.
+// sha256-<hex>.sig, and the tag of the referrers tag schema without a suffix
+var subjectTagRegex = regexp.MustCompile(`^(sha256|sha512)-([a-f0-9]{64}|[a-f0-9]{128})(\.(sig|att|sbom))?$`)
+
+// subjectOf returns the digest a signature, attestation or SBOM tag belongs to
+func subjectOf(tag string) (digest.Digest, bool) {
+	sub := subjectTagRegex.FindStringSubmatch(tag)
+	if sub == nil {
+		return "", false
+	}
+	d := digest.NewDigestFromHex(sub[1], sub[2])
+	if d.Validate() != nil {
+		return "", false
+	}
+	return d, true
+}
+
+// splitSubjectTags separates the tags of signatures, attestations and SBOMs
+// from the tags the rules apply to
+func splitSubjectTags(tags []string) ([]string, map[string]digest.Digest) {
+	ruleTags := make([]string, 0, len(tags))
+	artifacts := make(map[string]digest.Digest)
+	for _, tag := range tags {
+		if subject, ok := subjectOf(tag); ok {
+			artifacts[tag] = subject
+			continue
+		}
+		ruleTags = append(ruleTags, tag)
+	}
+	return ruleTags, artifacts
+}
+
+// subjectArtifacts returns the artifact tags whose subject is removed
+func subjectArtifacts(artifacts map[string]digest.Digest, removed []digest.Digest) []string {
+	removedSet := make(map[digest.Digest]bool)
+	for _, d := range removed {
+		removedSet[d] = true
+	}
+
+	ret := make([]string, 0)
+	for tag, subject := range artifacts {
+		if removedSet[subject] {
+			ret = append(ret, tag)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// subjectReferrers returns the manifests that refer to one of the removed
+// subjects with the referrers API
+func subjectReferrers(ctx context.Context, b backend, repo string, removed []digest.Digest) ([]digest.Digest, error) {
+	ret := make([]digest.Digest, 0)
+	seen := make(map[digest.Digest]bool)
+	for _, subject := range removed {
+		referrers, err := b.Referrers(ctx, repo, subject)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range referrers {
+			if !seen[d] {
+				seen[d] = true
+				ret = append(ret, d)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// getReferrers lists the manifests with subject dgst. Registries without the
+// referrers API answer not found, they have no referrers.
+func getReferrers(ctx context.Context, repo string, dgst digest.Digest) ([]digest.Digest, error) {
+	req, err := http.NewRequest("GET", hub.URL+"/v2/"+repo+"/referrers/"+dgst.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", mediaTypeOCIIndex)
+
+	resp, err := hub.Client.Do(req.WithContext(ctx))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	index := imageManifest{}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, err
+	}
+	referrers := make([]digest.Digest, 0, len(index.Manifests))
+	for _, m := range index.Manifests {
+		referrers = append(referrers, m.Digest)
+	}
+	return referrers, nil
+}
@@ -0,0 +1,149 @@
+// docker-unregstriy-untagger :- tests for signatures, attestations and SBOMs
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubjectOf(t *testing.T) {
+	subject := digest.FromString("image")
+	hex := subject.Hex()
+
+	var tests = []struct {
+		tag     string
+		subject digest.Digest
+		ok      bool
+	}{
+		{"sha256-" + hex + ".sig", subject, true},
+		{"sha256-" + hex + ".att", subject, true},
+		{"sha256-" + hex + ".sbom", subject, true},
+		{"sha256-" + hex, subject, true},
+		{"sha256-" + hex + ".foo", "", false},
+		{"sha256-" + hex[1:] + ".sig", "", false},
+		{"sha256-" + strings.ToUpper(hex) + ".sig", "", false},
+		{"build_1", "", false},
+	}
+
+	for i, tt := range tests {
+		subject, ok := subjectOf(tt.tag)
+		assert.Equal(t, tt.ok, ok, "TestSubjectOf "+strconv.Itoa(i+1)+" values should be equal")
+		assert.Equal(t, tt.subject, subject, "TestSubjectOf "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestSubjectArtifacts(t *testing.T) {
+	one, two := digest.FromString("1"), digest.FromString("2")
+	sig1, att1, sig2 := "sha256-"+one.Hex()+".sig", "sha256-"+one.Hex()+".att", "sha256-"+two.Hex()+".sig"
+
+	ruleTags, artifacts := splitSubjectTags([]string{"build_1", sig1, "build_2", att1, sig2})
+	assert.Equal(t, []string{"build_1", "build_2"}, ruleTags)
+	assert.Equal(t, map[string]digest.Digest{sig1: one, att1: one, sig2: two}, artifacts)
+
+	assert.Equal(t, []string{att1, sig1}, subjectArtifacts(artifacts, []digest.Digest{one}))
+	assert.Equal(t, []string{}, subjectArtifacts(artifacts, nil))
+}
+
+func TestGetReferrers(t *testing.T) {
+	f := newFakeRegistry()
+	subject := f.addManifest("app", mediaTypeOCIManifest, []byte(`{"mediaType":"`+mediaTypeOCIManifest+`"}`), "build_1")
+	sig := f.addManifest("app", mediaTypeOCIManifest, []byte(`{"mediaType":"`+mediaTypeOCIManifest+`","subject":{"digest":"`+subject.String()+`"}}`))
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	// registries without the referrers API have no referrers
+	referrers, err := getReferrers(context.Background(), "app", subject)
+	assert.NoError(t, err)
+	assert.Empty(t, referrers)
+
+	f.referrers = true
+	referrers, err = getReferrers(context.Background(), "app", subject)
+	assert.NoError(t, err)
+	assert.Equal(t, []digest.Digest{sig}, referrers)
+
+	referrers, err = getReferrers(context.Background(), "app", sig)
+	assert.NoError(t, err)
+	assert.Empty(t, referrers)
+}
+
+func TestCleanRepositorySubjects(t *testing.T) {
+	oldRules := rules
+	defer func() { rules = oldRules }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+		MinAge:             7,
+	}
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	one, two := digest.FromString("1"), digest.FromString("2")
+	sig1, att1, sig2 := "sha256-"+one.Hex()+".sig", "sha256-"+one.Hex()+".att", "sha256-"+two.Hex()+".sig"
+	referrer1, referrer2 := digest.FromString("referrer 1"), digest.FromString("referrer 2")
+
+	for i, tagDelete := range []bool{false, true} {
+		b := newMemoryBackend(tagDelete, true)
+		b.add("app", "build_1", one, old)
+		b.add("app", "build_2", two, old)
+		b.add("app", sig1, digest.FromString("sig 1"), old)
+		b.add("app", att1, digest.FromString("att 1"), old)
+		b.add("app", sig2, digest.FromString("sig 2"), old)
+		b.referrers = map[digest.Digest][]digest.Digest{one: {referrer1}, two: {referrer2}}
+
+		_, _, err := cleanRepository(context.Background(), context.Background(), b, "app", &runSummary{})
+		assert.NoError(t, err)
+		// the tags of signatures are not invalid, they follow their subject
+		assert.Equal(t, []string{"build_2", sig2}, b.names("app"), "TestCleanRepositorySubjects "+strconv.Itoa(i+1)+" values should be equal")
+		assert.Contains(t, b.deleted, referrer1, "TestCleanRepositorySubjects "+strconv.Itoa(i+1)+" referrer should be removed")
+		assert.NotContains(t, b.deleted, referrer2, "TestCleanRepositorySubjects "+strconv.Itoa(i+1)+" referrer should be kept")
+	}
+}
+
+func TestCleanRepositorySubjectsRegistry(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	oldRules, oldDryRun := rules, dryRun
+	defer func() { rules, dryRun = oldRules, oldDryRun }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+	}
+	dryRun = false
+
+	manifest := func(i int) []byte {
+		return []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `","config":{"digest":"sha256:0` + strconv.Itoa(i) + `"}}`)
+	}
+	one := f.addManifest("app", schema2.MediaTypeManifest, manifest(1), "build_1")
+	f.addManifest("app", schema2.MediaTypeManifest, manifest(2), "build_2")
+	// cosign stores signatures as OCI manifests
+	sig := "sha256-" + one.Hex() + ".sig"
+	sigDigest := f.addManifest("app", mediaTypeOCIManifest, []byte(`{"schemaVersion":2,"mediaType":"`+mediaTypeOCIManifest+`","layers":[]}`), sig)
+
+	// the vendored client only accepts schema2 and does not find it
+	_, err := hub.ManifestDigest("app", sig)
+	assert.Error(t, err)
+	dgst, err := manifestDigest(context.Background(), "app", sig)
+	assert.NoError(t, err)
+	assert.Equal(t, sigDigest, dgst)
+
+	removed, _, err := cleanRepository(context.Background(), context.Background(), &registryBackend{}, "app", &runSummary{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, []string{"build_2"}, f.tagsOf("app"))
+}
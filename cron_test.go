@@ -0,0 +1,64 @@
+// docker-unregstriy-untagger :- tests for cron expressions
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	var tests = []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt)
+		if err == nil {
+			t.Errorf("parseCron(%q) => nil, want error", tt)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2017-03-01 is a wednesday
+	from := time.Date(2017, 3, 1, 10, 30, 0, 0, time.UTC)
+
+	var tests = []struct {
+		inExpr string
+		out    time.Time
+	}{
+		{"* * * * *", time.Date(2017, 3, 1, 10, 31, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2017, 3, 2, 3, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 3, 1, 10, 45, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2017, 3, 2, 10, 30, 0, 0, time.UTC)},
+		{"0 1 * * 0", time.Date(2017, 3, 5, 1, 0, 0, 0, time.UTC)},
+		{"0 1 * * 7", time.Date(2017, 3, 5, 1, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 1", time.Date(2017, 3, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 2 1-7 1,6 *", time.Date(2017, 6, 1, 2, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for i, tt := range tests {
+		c, err := parseCron(tt.inExpr)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.out, c.next(from), "TestCronNext "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
@@ -0,0 +1,55 @@
+// docker-unregstriy-untagger :- daemon mode
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// nextRun returns the next scheduled time after now delayed by a random jitter
+func nextRun(schedule *cronSchedule, jitter time.Duration, now time.Time) time.Time {
+	next := schedule.next(now)
+	if jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	return next
+}
+
+// runDaemon runs immediately and then on every scheduled time. Runs are
+// executed one after another, a schedule that is missed because the previous
+// run took too long is skipped instead of starting a second run. It returns
+// once stopping is done.
+func runDaemon(ctx, stopping context.Context, schedule *cronSchedule, jitter time.Duration) {
+	rand.Seed(time.Now().UnixNano())
+
+	for {
+		summary, err := run(ctx, stopping)
+		if err != nil {
+			log.Printf("run failed: %s (%s)", err, summary)
+		} else {
+			log.Printf("run finished: %s", summary)
+		}
+
+		next := nextRun(schedule, jitter, time.Now())
+		if next.IsZero() {
+			log.Fatalf("schedule %q has no next run", cfg.Schedule)
+		}
+		if stopping.Err() != nil {
+			return
+		}
+
+		log.Printf("next run at %s", next.Format(time.RFC3339))
+		select {
+		case <-time.After(next.Sub(time.Now())):
+		case <-stopping.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// docker-unregstriy-untagger :- tests for the daemon mode
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextRun(t *testing.T) {
+	schedule, err := parseCron("0 3 * * *")
+	assert.NoError(t, err)
+
+	now := time.Date(2017, 3, 1, 10, 30, 0, 0, time.UTC)
+	scheduled := time.Date(2017, 3, 2, 3, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, scheduled, nextRun(schedule, 0, now))
+
+	for i := 0; i < 100; i++ {
+		next := nextRun(schedule, 10*time.Minute, now)
+		if next.Before(scheduled) || !next.Before(scheduled.Add(10*time.Minute)) {
+			t.Errorf("nextRun() => %s, want between %s and 10 minutes later", next, scheduled)
+		}
+	}
+}
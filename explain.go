@@ -0,0 +1,213 @@
+// docker-unregstriy-untagger :- explain the decisions of the rules
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// tagDecision is what the rules do with a tag and why
+type tagDecision struct {
+	Tag     string
+	Remove  bool
+	Invalid bool
+	Reason  string
+}
+
+func (d tagDecision) action() string {
+	if d.Remove {
+		return "remove"
+	}
+	return "keep"
+}
+
+// explainRepository evaluates the rules for every tag of repo with the
+// decisions of cleanRepository and keeps the reason of every decision. The
+// quarantine is not taken into account.
+func explainRepository(ctx context.Context, b backend, repo string, now time.Time) ([]tagDecision, error) {
+	infos, err := b.Tags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	tagDelete := b.Capabilities().TagDelete
+	b = newListedTags(b, infos)
+	ruleTags, artifacts := splitSubjectTags(tagNames(infos))
+
+	decisions, digests, err := decideTags(ctx, b, repo, ruleTags, tagDelete, now, &recheckTime{})
+	if err != nil {
+		return nil, err
+	}
+
+	// a digest is only removed if no kept tag points to it
+	kept := make(map[digest.Digest]bool)
+	removed := make(map[digest.Digest]bool)
+	for _, d := range decisions {
+		if d.Remove {
+			removed[digests[d.Tag]] = true
+		} else {
+			kept[digests[d.Tag]] = true
+		}
+	}
+	for tag, subject := range artifacts {
+		d := tagDecision{Tag: tag, Reason: "kept with its subject " + subject.String()}
+		if removed[subject] && !kept[subject] {
+			d.Remove, d.Reason = true, "removed with its subject "+subject.String()
+		}
+		decisions = append(decisions, d)
+	}
+
+	sort.Slice(decisions, func(i, j int) bool { return decisions[i].Tag < decisions[j].Tag })
+	return decisions, nil
+}
+
+// decideTags is what the rules do with the tags of repo, both cleanRepository
+// and explainRepository use it. The metadata of the candidates and the
+// digests of all tags are looked up in parallel, the digests are returned
+// with the decisions. recheck is set to the first time a tag that is too
+// young gets old enough.
+func decideTags(ctx context.Context, b backend, repo string, tags []string, tagDelete bool, now time.Time, recheck *recheckTime) ([]tagDecision, map[string]digest.Digest, error) {
+	invalid := make(map[string]bool)
+	for _, tag := range getInvalidTags(rules.ValidTagsRegex, tags) {
+		invalid[tag] = true
+	}
+	expired := make(map[string]string)
+	newest := make(map[string]string)
+	for flavor, ftags := range getFlavor(rules.SortAndFilterRegex, tags) {
+		for _, tag := range getExpiredBuildTags(rules.KeepNewestBySort, rules.SortAndFilterRegex, ftags) {
+			expired[tag] = flavor
+		}
+		for _, tag := range ftags {
+			if _, ok := expired[tag.name]; !ok {
+				newest[tag.name] = flavor
+			}
+		}
+	}
+
+	decisions := make([]tagDecision, 0, len(tags))
+	candidates := make([]string, 0)
+	for _, tag := range tags {
+		d := tagDecision{Tag: tag}
+		switch flavor, isExpired := expired[tag]; {
+		case invalid[tag]:
+			d.Remove, d.Invalid, d.Reason = true, true, "matches none of validTags"
+		case isExpired:
+			d.Remove, d.Reason = true, fmt.Sprintf("not one of the newest %d builds of flavor %s", rules.KeepNewestBySort, flavor)
+		case newest[tag] != "":
+			d.Reason = fmt.Sprintf("one of the newest %d builds of flavor %s", rules.KeepNewestBySort, newest[tag])
+		default:
+			d.Reason = "matches validTags and is no build"
+		}
+		if d.Remove && rules.MinAge < 0 {
+			d.Remove, d.Reason = false, d.Reason+", but minAgeBeforeDelete is negative"
+		}
+		if d.Remove {
+			candidates = append(candidates, tag)
+		}
+		decisions = append(decisions, d)
+	}
+
+	created := make(map[string]time.Time)
+	if rules.MinAge > 0 {
+		var err error
+		created, err = createdOfTags(ctx, b, repo, candidates)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	digests, err := digestOfTags(ctx, b, repo, tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keptBy := make(map[digest.Digest]string)
+	for i, d := range decisions {
+		if d.Remove && rules.MinAge > 0 && !olderThan(rules.MinAge, created[d.Tag], now, recheck) {
+			decisions[i].Remove = false
+			decisions[i].Reason = fmt.Sprintf("%s, but younger than %d days (created %s)", d.Reason, rules.MinAge, created[d.Tag].Format(time.RFC3339))
+		}
+		if !decisions[i].Remove {
+			keptBy[digests[d.Tag]] = d.Tag
+		}
+	}
+
+	// a tag of a kept digest can only go if the registry removes single tags
+	if !tagDelete {
+		for i, d := range decisions {
+			if kept, ok := keptBy[digests[d.Tag]]; d.Remove && ok {
+				decisions[i].Remove, decisions[i].Reason = false, fmt.Sprintf("%s, but shares its digest with kept tag %s", d.Reason, kept)
+			}
+		}
+	}
+	return decisions, digests, nil
+}
+
+// createdOfTags looks up the creation time of the tags in parallel
+func createdOfTags(ctx context.Context, b backend, repo string, tags []string) (map[string]time.Time, error) {
+	created := make(map[string]time.Time)
+	var mutex sync.Mutex
+	_, err := parallelFilterErr(tags, func(tag string) (bool, error) {
+		downloads <- true
+		m, err := b.Metadata(ctx, repo, tag)
+		<-downloads
+		if err != nil {
+			return false, fmt.Errorf("metadata of %s: %s", tag, err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		created[tag] = m.Created
+		return true, nil
+	})
+	return created, err
+}
+
+// digestOfTags looks up the digest of the tags in parallel
+func digestOfTags(ctx context.Context, b backend, repo string, tags []string) (map[string]digest.Digest, error) {
+	digests := make(map[string]digest.Digest)
+	var mutex sync.Mutex
+	_, err := parallelFilterErr(tags, func(tag string) (bool, error) {
+		downloads <- true
+		dgst, err := b.Digest(ctx, repo, tag)
+		<-downloads
+		if err != nil {
+			return false, fmt.Errorf("digest of %s: %s", tag, err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		digests[tag] = dgst
+		return true, nil
+	})
+	return digests, err
+}
+
+// decisionCounts sums up the decisions for a repository
+type decisionCounts struct {
+	Tags    int
+	Invalid int
+	Kept    int
+	Removed int
+}
+
+func countDecisions(decisions []tagDecision) decisionCounts {
+	c := decisionCounts{Tags: len(decisions)}
+	for _, d := range decisions {
+		if d.Invalid {
+			c.Invalid++
+		}
+		if d.Remove {
+			c.Removed++
+		} else {
+			c.Kept++
+		}
+	}
+	return c
+}
@@ -0,0 +1,140 @@
+// docker-unregstriy-untagger :- tests for explain
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainRepository(t *testing.T) {
+	oldRules := rules
+	defer func() { rules = oldRules }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+		MinAge:             7,
+	}
+
+	now := time.Now()
+	old := now.Add(-30 * 24 * time.Hour)
+	sig := "sha256-" + digest.FromString("3").Hex() + ".sig"
+
+	var tests = []struct {
+		tagDelete bool
+		remove    map[string]bool
+	}{
+		{false, map[string]bool{"build_1": false, "build_2": true, "build_3": true, "build_4": false, "build_5": false, "latest": true, "release_1": false, sig: true}},
+		{true, map[string]bool{"build_1": true, "build_2": true, "build_3": true, "build_4": false, "build_5": false, "latest": true, "release_1": false, sig: true}},
+	}
+
+	for i, tt := range tests {
+		b := newMemoryBackend(tt.tagDelete, true)
+		b.add("app", "build_1", digest.FromString("1"), old)
+		b.add("app", "release_1", digest.FromString("1"), old)
+		b.add("app", "build_2", digest.FromString("2"), old)
+		b.add("app", "build_3", digest.FromString("3"), old)
+		b.add("app", "build_4", digest.FromString("4"), now)
+		b.add("app", "build_5", digest.FromString("5"), old)
+		b.add("app", "latest", digest.FromString("6"), old)
+		b.add("app", sig, digest.FromString("sig"), old)
+
+		decisions, err := explainRepository(context.Background(), b, "app", now)
+		assert.NoError(t, err)
+
+		remove := make(map[string]bool)
+		for _, d := range decisions {
+			remove[d.Tag] = d.Remove
+			assert.NotEmpty(t, d.Reason, d.Tag+" needs a reason")
+		}
+		assert.Equal(t, tt.remove, remove, "TestExplainRepository "+strconv.Itoa(i+1)+" values should be equal")
+		assert.Equal(t, decisionCounts{Tags: 8, Invalid: 1, Kept: 8 - countRemoved(tt.remove), Removed: countRemoved(tt.remove)}, countDecisions(decisions),
+			"TestExplainRepository "+strconv.Itoa(i+1)+" values should be equal")
+
+		// explain agrees with the cleanup
+		_, _, err = cleanRepository(context.Background(), context.Background(), b, "app", &runSummary{})
+		assert.NoError(t, err)
+		for _, tag := range b.names("app") {
+			assert.False(t, tt.remove[tag], "TestExplainRepository "+strconv.Itoa(i+1)+" "+tag+" should be removed")
+		}
+		assert.Equal(t, 8-countRemoved(tt.remove), len(b.names("app")), "TestExplainRepository "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestDecisionsAgree(t *testing.T) {
+	oldRules := rules
+	defer func() { rules = oldRules }()
+
+	now := time.Now()
+	old := now.Add(-30 * 24 * time.Hour)
+	type image struct {
+		tag     string
+		digest  string
+		created time.Time
+	}
+	images := []image{
+		{"build_1", "1", old}, {"release_1", "1", old}, {"build_2", "2", old}, {"build_3", "3", now},
+		{"build_4", "4", old}, {"centos7_build_1", "5", old}, {"centos7_build_2", "6", old},
+		{"latest", "4", old}, {"nightly", "7", old}, {"sha256-" + digest.FromString("2").Hex() + ".sig", "8", old},
+	}
+
+	var tests = []struct {
+		minAge    int
+		keep      int
+		tagDelete bool
+	}{
+		{0, 1, false},
+		{0, 1, true},
+		{7, 1, false},
+		{7, 2, true},
+		{-1, 1, false},
+		{0, 0, true},
+	}
+	for i, tt := range tests {
+		rules = rule{
+			ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("build_[0-9]+$"), regexp.MustCompile("^latest$")},
+			SortAndFilterRegex: regexp.MustCompile("(.*)build_([0-9]+)"),
+			KeepNewestBySort:   tt.keep,
+			MinAge:             tt.minAge,
+		}
+		b := newMemoryBackend(tt.tagDelete, true)
+		for _, img := range images {
+			b.add("app", img.tag, digest.FromString(img.digest), img.created)
+		}
+
+		decisions, err := explainRepository(context.Background(), b, "app", now)
+		assert.NoError(t, err)
+		kept := make([]string, 0)
+		for _, d := range decisions {
+			if !d.Remove {
+				kept = append(kept, d.Tag)
+			}
+		}
+
+		removed, _, err := cleanRepository(context.Background(), context.Background(), b, "app", &runSummary{})
+		assert.NoError(t, err)
+		assert.Equal(t, countDecisions(decisions).Removed, removed, "TestDecisionsAgree "+strconv.Itoa(i+1)+" values should be equal")
+		assert.Equal(t, kept, b.names("app"), "TestDecisionsAgree "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func countRemoved(remove map[string]bool) int {
+	n := 0
+	for _, r := range remove {
+		if r {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,230 @@
+// docker-unregstriy-untagger :- in memory registry for tests
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/wind0r/docker-registry-client/registry"
+)
+
+type fakeManifest struct {
+	mediaType string
+	payload   []byte
+}
+
+type fakeRepo struct {
+	manifests map[digest.Digest]fakeManifest
+	tags      map[string]digest.Digest
+	blobs     map[digest.Digest][]byte
+}
+
+// fakeRegistry implements the parts of the registry API the untagger uses
+type fakeRegistry struct {
+	sync.Mutex
+	repos    map[string]*fakeRepo
+	requests []string
+	// tagDeletion allows to delete manifests by tag, otherwise only
+	// digests are accepted like in distribution v2
+	tagDeletion bool
+	// referrers enables the referrers API of OCI distribution 1.1
+	referrers bool
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{repos: make(map[string]*fakeRepo)}
+}
+
+func (f *fakeRegistry) repo(name string) *fakeRepo {
+	r, ok := f.repos[name]
+	if !ok {
+		r = &fakeRepo{
+			manifests: make(map[digest.Digest]fakeManifest),
+			tags:      make(map[string]digest.Digest),
+			blobs:     make(map[digest.Digest][]byte),
+		}
+		f.repos[name] = r
+	}
+	return r
+}
+
+func (f *fakeRegistry) addBlob(repo string, content []byte) digest.Digest {
+	f.Lock()
+	defer f.Unlock()
+	d := digest.FromBytes(content)
+	f.repo(repo).blobs[d] = content
+	return d
+}
+
+func (f *fakeRegistry) addManifest(repo, mediaType string, payload []byte, tags ...string) digest.Digest {
+	f.Lock()
+	defer f.Unlock()
+	d := digest.FromBytes(payload)
+	r := f.repo(repo)
+	r.manifests[d] = fakeManifest{mediaType: mediaType, payload: payload}
+	for _, tag := range tags {
+		r.tags[tag] = d
+	}
+	return d
+}
+
+func (f *fakeRegistry) tagsOf(repo string) []string {
+	f.Lock()
+	defer f.Unlock()
+	ret := make([]string, 0)
+	for tag := range f.repo(repo).tags {
+		ret = append(ret, tag)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path)
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case path == "_catalog":
+		names := make([]string, 0)
+		for name := range f.repos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": names})
+	case strings.HasSuffix(path, "/tags/list"):
+		r := f.repo(strings.TrimSuffix(path, "/tags/list"))
+		tags := make([]string, 0)
+		for tag := range r.tags {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(map[string][]string{"tags": tags})
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		f.serveManifest(w, req, f.repo(parts[0]), parts[1])
+	case f.referrers && strings.Contains(path, "/referrers/"):
+		parts := strings.SplitN(path, "/referrers/", 2)
+		f.serveReferrers(w, f.repo(parts[0]), digest.Digest(parts[1]))
+	case strings.Contains(path, "/blobs/"):
+		parts := strings.SplitN(path, "/blobs/", 2)
+		blob, ok := f.repo(parts[0]).blobs[digest.Digest(parts[1])]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		if req.Method == "GET" {
+			w.Write(blob)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, r *fakeRepo, reference string) {
+	d, ok := r.tags[reference]
+	if !ok {
+		d = digest.Digest(reference)
+	}
+
+	switch req.Method {
+	case "PUT":
+		payload, _ := ioutil.ReadAll(req.Body)
+		d = digest.FromBytes(payload)
+		r.manifests[d] = fakeManifest{mediaType: req.Header.Get("Content-Type"), payload: payload}
+		if d.String() != reference {
+			r.tags[reference] = d
+		}
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(http.StatusCreated)
+		return
+	case "DELETE":
+		if _, err := digest.Parse(reference); err != nil {
+			if !f.tagDeletion {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if _, ok := r.tags[reference]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+				return
+			}
+			delete(r.tags, reference)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if _, ok := r.manifests[d]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(r.manifests, d)
+		for tag, td := range r.tags {
+			if td == d {
+				delete(r.tags, tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	m, ok := r.manifests[d]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// like distribution, OCI manifests are only served if they are accepted
+	if (m.mediaType == mediaTypeOCIManifest || m.mediaType == mediaTypeOCIIndex) && !strings.Contains(req.Header.Get("Accept"), m.mediaType) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"OCI manifest found, but accept header does not support OCI manifests"}]}`))
+		return
+	}
+	w.Header().Set("Content-Type", m.mediaType)
+	w.Header().Set("Docker-Content-Digest", d.String())
+	if req.Method == "GET" {
+		w.Write(m.payload)
+	}
+}
+
+// serveReferrers lists the manifests with subject as index
+func (f *fakeRegistry) serveReferrers(w http.ResponseWriter, r *fakeRepo, subject digest.Digest) {
+	index := imageManifest{MediaType: mediaTypeOCIIndex, Manifests: []descriptor{}}
+	for d, m := range r.manifests {
+		var referrer struct {
+			Subject *descriptor `json:"subject"`
+		}
+		if json.Unmarshal(m.payload, &referrer) != nil || referrer.Subject == nil || referrer.Subject.Digest != subject {
+			continue
+		}
+		index.Manifests = append(index.Manifests, descriptor{MediaType: m.mediaType, Digest: d, Size: int64(len(m.payload))})
+	}
+	sort.Slice(index.Manifests, func(i, j int) bool { return index.Manifests[i].Digest < index.Manifests[j].Digest })
+	w.Header().Set("Content-Type", mediaTypeOCIIndex)
+	json.NewEncoder(w).Encode(index)
+}
+
+// startFakeRegistry serves f and points hub at it
+func startFakeRegistry(f http.Handler) *httptest.Server {
+	srv := httptest.NewServer(f)
+	hub = &registry.Registry{
+		URL:    srv.URL,
+		Client: &http.Client{Transport: registry.WrapTransport(http.DefaultTransport, srv.URL, "", "")},
+		Logf:   registry.Quiet,
+	}
+	return srv
+}
@@ -0,0 +1,215 @@
+// docker-unregstriy-untagger :- garbage collection planner for filesystem storage
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// revisions returns all manifests stored in repo, tagged or not
+func (s *storage) revisions(repo string) ([]digest.Digest, error) {
+	base := s.repoPath(repo, "_manifests", "revisions")
+	revisions := make([]digest.Digest, 0)
+
+	algorithms, err := ioutil.ReadDir(base)
+	if os.IsNotExist(err) {
+		return revisions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, algorithm := range algorithms {
+		hexes, err := ioutil.ReadDir(filepath.Join(base, algorithm.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, hex := range hexes {
+			dgst, err := readLink(filepath.Join(base, algorithm.Name(), hex.Name(), "link"))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			revisions = append(revisions, dgst)
+		}
+	}
+	return revisions, nil
+}
+
+// mark adds a manifest, its config and layers and for an index all child
+// manifests to marked
+func (s *storage) mark(dgst digest.Digest, marked map[digest.Digest]bool) error {
+	if marked[dgst] {
+		return nil
+	}
+	marked[dgst] = true
+
+	payload, err := ioutil.ReadFile(s.blobPath(dgst))
+	if err != nil {
+		return fmt.Errorf("manifest %s: %s", dgst, err)
+	}
+	m, err := parseManifest("", payload)
+	if err != nil {
+		return fmt.Errorf("manifest %s: %s", dgst, err)
+	}
+
+	for _, blob := range m.blobs() {
+		marked[blob.Digest] = true
+	}
+	for _, child := range m.Manifests {
+		if err := s.mark(child.Digest, marked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markAll marks everything referenced by any manifest in any repository
+func (s *storage) markAll() (map[digest.Digest]bool, error) {
+	repos, err := s.repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	marked := make(map[digest.Digest]bool)
+	for _, repo := range repos {
+		revisions, err := s.revisions(repo)
+		if err != nil {
+			return nil, err
+		}
+		for _, dgst := range revisions {
+			if err := s.mark(dgst, marked); err != nil {
+				return nil, fmt.Errorf("%s: %s", repo, err)
+			}
+		}
+	}
+	return marked, nil
+}
+
+type storedBlob struct {
+	Digest digest.Digest
+	Size   int64
+}
+
+// blobs lists every blob in the storage with its size
+func (s *storage) blobs() ([]storedBlob, error) {
+	base := filepath.Join(s.root, "blobs")
+	blobs := make([]storedBlob, 0)
+	err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == base {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "data" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		// <algorithm>/<first two hex>/<hex>/data
+		parts := splitPath(rel)
+		if len(parts) != 4 {
+			return nil
+		}
+		dgst := digest.NewDigestFromHex(parts[0], parts[2])
+		if dgst.Validate() != nil {
+			return nil
+		}
+		blobs = append(blobs, storedBlob{Digest: dgst, Size: info.Size()})
+		return nil
+	})
+	return blobs, err
+}
+
+func splitPath(path string) []string {
+	parts := make([]string, 0)
+	for path != "" && path != "." {
+		dir, file := filepath.Split(path)
+		parts = append([]string{file}, parts...)
+		path = filepath.Clean(dir)
+		if path == string(filepath.Separator) {
+			break
+		}
+	}
+	return parts
+}
+
+// gcPlan are the blobs no manifest references anymore
+type gcPlan struct {
+	Unreferenced []storedBlob
+	Size         int64
+}
+
+func (s *storage) planGC() (gcPlan, error) {
+	plan := gcPlan{Unreferenced: make([]storedBlob, 0)}
+
+	marked, err := s.markAll()
+	if err != nil {
+		return plan, err
+	}
+	blobs, err := s.blobs()
+	if err != nil {
+		return plan, err
+	}
+
+	for _, blob := range blobs {
+		if !marked[blob.Digest] {
+			plan.Unreferenced = append(plan.Unreferenced, blob)
+			plan.Size += blob.Size
+		}
+	}
+	sort.Slice(plan.Unreferenced, func(i, j int) bool {
+		return plan.Unreferenced[i].Digest < plan.Unreferenced[j].Digest
+	})
+	return plan, nil
+}
+
+// sweep removes the blob directories of the plan
+func (s *storage) sweep(plan gcPlan) error {
+	for _, blob := range plan.Unreferenced {
+		if err := os.RemoveAll(filepath.Dir(s.blobPath(blob.Digest))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// garbageCollect lists the unreferenced blobs of the storage and removes
+// them if confirmed
+func garbageCollect(path string, confirmed bool) error {
+	s := newStorage(path)
+	plan, err := s.planGC()
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range plan.Unreferenced {
+		fmt.Println(blob.Digest, formatBytes(blob.Size))
+	}
+	fmt.Println("Unreferenced blobs: ", len(plan.Unreferenced), "Size: ", formatBytes(plan.Size))
+
+	if !confirmed {
+		fmt.Println("Nothing was removed, use -confirm to remove the blobs")
+		return nil
+	}
+	if err := s.sweep(plan); err != nil {
+		return err
+	}
+	fmt.Println("Removed blobs: ", len(plan.Unreferenced))
+	return nil
+}
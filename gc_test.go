@@ -0,0 +1,69 @@
+// docker-unregstriy-untagger :- tests for the garbage collection planner
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanGC(t *testing.T) {
+	f := newFakeStorage(t)
+	defer os.RemoveAll(f.path)
+
+	config := f.addBlob("team/app", []byte(`{"architecture":"amd64"}`))
+	layer := f.addBlob("team/app", []byte("layer"))
+	child := []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `","config":{"digest":"` + config.String() + `"},"layers":[{"digest":"` + layer.String() + `"}]}`)
+	childDigest := digest.FromBytes(child)
+	// the child is only stored as blob, the index has to keep it
+	f.write(f.s.blobPath(childDigest), child)
+	index := f.addManifest("team/app", []byte(`{"schemaVersion":2,"mediaType":"`+mediaTypeManifestList+`","manifests":[{"digest":"`+childDigest.String()+`"}]}`), "latest")
+
+	untagged := f.addManifest("team/app", []byte(`{"schemaVersion":1,"fsLayers":[{"blobSum":"`+layer.String()+`"}]}`))
+
+	orphan := f.addBlob("other", []byte("orphaned layer"))
+	removed := f.addBlob("other", []byte(`{"schemaVersion":2}`))
+
+	plan, err := f.s.planGC()
+	assert.NoError(t, err)
+	assert.Len(t, plan.Unreferenced, 2)
+	assert.Equal(t, int64(len("orphaned layer")+len(`{"schemaVersion":2}`)), plan.Size)
+	for _, blob := range plan.Unreferenced {
+		assert.Contains(t, []digest.Digest{orphan, removed}, blob.Digest)
+	}
+
+	assert.NoError(t, f.s.sweep(plan))
+	for _, d := range []digest.Digest{orphan, removed} {
+		_, err := os.Stat(f.s.blobPath(d))
+		assert.True(t, os.IsNotExist(err), "TestPlanGC blob should be removed")
+	}
+	for _, d := range []digest.Digest{config, layer, childDigest, index, untagged} {
+		_, err := os.Stat(f.s.blobPath(d))
+		assert.NoError(t, err, "TestPlanGC blob should be kept")
+	}
+
+	plan, err = f.s.planGC()
+	assert.NoError(t, err)
+	assert.Len(t, plan.Unreferenced, 0)
+}
+
+func TestPlanGCMissingManifest(t *testing.T) {
+	f := newFakeStorage(t)
+	defer os.RemoveAll(f.path)
+
+	d := digest.FromString("missing")
+	f.addBlob("team/app", []byte("layer"))
+	f.write(f.s.repoPath("team/app", "_manifests", "revisions", "sha256", d.Hex(), "link"), []byte(d.String()))
+
+	// without the manifest nothing is known to be unreferenced
+	_, err := f.s.planGC()
+	assert.Error(t, err)
+}
@@ -0,0 +1,386 @@
+// docker-unregstriy-untagger :- gitlab container registry backend
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/wind0r/docker-registry-client/registry"
+)
+
+const (
+	typeGitlab = "gitlab"
+
+	gitlabAPI     = "/api/v4"
+	gitlabPerPage = 100
+	// gitlabRetries is how often a request is repeated after 429 Too Many Requests
+	gitlabRetries = 5
+)
+
+type gitlabRepository struct {
+	ID        int    `json:"id"`
+	Path      string `json:"path"`
+	ProjectID int    `json:"project_id"`
+}
+
+type gitlabTag struct {
+	Name      string        `json:"name"`
+	Digest    digest.Digest `json:"digest"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// gitlabClient talks to the container registry API of gitlab
+type gitlabClient struct {
+	url    string
+	client *http.Client
+
+	sync.Mutex
+	repositories map[string]gitlabRepository
+}
+
+func newGitlabClient(url, token string, transport http.RoundTripper) *gitlabClient {
+	return &gitlabClient{
+		url: strings.TrimSuffix(url, "/"),
+		client: &http.Client{
+			Transport: &registry.ErrorTransport{
+				Transport: &gitlabTransport{token: token, Transport: transport},
+			},
+		},
+		repositories: make(map[string]gitlabRepository),
+	}
+}
+
+// connectGitlab creates the gitlab client for host and checks the token
+func connectGitlab(ctx context.Context) (*gitlabClient, error) {
+	transport, err := hostTransport(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	g := newGitlabClient(cfg.Host, cfg.Password, transport)
+	resp, err := g.request(ctx, "GET", gitlabAPI+"/version")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return g, nil
+}
+
+func (g *gitlabClient) request(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, g.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return g.client.Do(req.WithContext(ctx))
+}
+
+// pages requests every page of path and passes the bodies to decode
+func (g *gitlabClient) pages(ctx context.Context, path string, decode func(io.Reader) error) error {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	for page := "1"; page != ""; {
+		resp, err := g.request(ctx, "GET", path+separator+"per_page="+strconv.Itoa(gitlabPerPage)+"&page="+page)
+		if err != nil {
+			return err
+		}
+		err = decode(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		page = resp.Header.Get("X-Next-Page")
+	}
+	return nil
+}
+
+// repository finds the registry repository of a path like group/project/image.
+// The project is not known, so all prefixes of the path are tried from the
+// longest on.
+func (g *gitlabClient) repository(ctx context.Context, path string) (gitlabRepository, error) {
+	g.Lock()
+	repo, ok := g.repositories[path]
+	g.Unlock()
+	if ok {
+		return repo, nil
+	}
+
+	parts := strings.Split(path, "/")
+	for i := len(parts); i > 0; i-- {
+		project := strings.Join(parts[:i], "/")
+		repos := make([]gitlabRepository, 0)
+		err := g.pages(ctx, gitlabAPI+"/projects/"+url.PathEscape(project)+"/registry/repositories", func(body io.Reader) error {
+			page := make([]gitlabRepository, 0)
+			if err := json.NewDecoder(body).Decode(&page); err != nil {
+				return err
+			}
+			repos = append(repos, page...)
+			return nil
+		})
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return repo, err
+		}
+
+		g.Lock()
+		for _, r := range repos {
+			g.repositories[r.Path] = r
+		}
+		repo, ok = g.repositories[path]
+		g.Unlock()
+		if ok {
+			return repo, nil
+		}
+	}
+	return repo, fmt.Errorf("gitlab registry repository %q not found", path)
+}
+
+func (g *gitlabClient) tagsPath(repo gitlabRepository) string {
+	return gitlabAPI + "/projects/" + strconv.Itoa(repo.ProjectID) + "/registry/repositories/" + strconv.Itoa(repo.ID) + "/tags"
+}
+
+// tags lists all tags of path with digest and creation time. Older gitlab
+// versions only return them in the details of a tag.
+func (g *gitlabClient) tags(ctx context.Context, path string) ([]gitlabTag, error) {
+	repo, err := g.repository(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]gitlabTag, 0)
+	err = g.pages(ctx, g.tagsPath(repo), func(body io.Reader) error {
+		page := make([]gitlabTag, 0)
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return err
+		}
+		tags = append(tags, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	for i := range tags {
+		if tags[i].Digest != "" && !tags[i].CreatedAt.IsZero() {
+			continue
+		}
+		wg.Add(1)
+		downloads <- true
+		go func(tag *gitlabTag) {
+			defer wg.Done()
+			defer func() { <-downloads }()
+
+			resp, err := g.request(ctx, "GET", g.tagsPath(repo)+"/"+url.PathEscape(tag.Name))
+			if err == nil {
+				err = json.NewDecoder(resp.Body).Decode(tag)
+				resp.Body.Close()
+			}
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("details of %s: %s", tag.Name, err)
+				}
+				mutex.Unlock()
+			}
+		}(&tags[i])
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return tags, nil
+}
+
+// deleteTag removes a single tag of path
+func (g *gitlabClient) deleteTag(ctx context.Context, path, tag string) error {
+	repo, err := g.repository(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	resp, err := g.request(ctx, "DELETE", g.tagsPath(repo)+"/"+url.PathEscape(tag))
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// gitlabBackend removes single tags with the container registry API of
+// gitlab, manifests are not available
+type gitlabBackend struct {
+	client *gitlabClient
+}
+
+func (g *gitlabBackend) Repositories(ctx context.Context) ([]string, error) {
+	return nil, fmt.Errorf("listing all repositories is not supported for gitlab")
+}
+
+func (g *gitlabBackend) Tags(ctx context.Context, repo string) ([]tagInfo, error) {
+	tags, err := g.client.tags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]tagInfo, 0, len(tags))
+	for _, tag := range tags {
+		infos = append(infos, tagInfo{Name: tag.Name, Digest: tag.Digest, Created: tag.CreatedAt})
+	}
+	return infos, nil
+}
+
+// tag returns the details of a single tag
+func (g *gitlabBackend) tag(ctx context.Context, path, name string) (gitlabTag, error) {
+	tag := gitlabTag{}
+	repo, err := g.client.repository(ctx, path)
+	if err != nil {
+		return tag, err
+	}
+
+	resp, err := g.client.request(ctx, "GET", g.client.tagsPath(repo)+"/"+url.PathEscape(name))
+	if err != nil {
+		return tag, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&tag)
+	return tag, err
+}
+
+func (g *gitlabBackend) Digest(ctx context.Context, repo, tag string) (digest.Digest, error) {
+	t, err := g.tag(ctx, repo, tag)
+	return t.Digest, err
+}
+
+func (g *gitlabBackend) Metadata(ctx context.Context, repo, tag string) (imageMetadata, error) {
+	t, err := g.tag(ctx, repo, tag)
+	return imageMetadata{Created: t.CreatedAt}, err
+}
+
+func (g *gitlabBackend) DeleteTag(ctx context.Context, repo, tag string, dgst digest.Digest) error {
+	return g.client.deleteTag(ctx, repo, tag)
+}
+
+func (g *gitlabBackend) DeleteDigest(ctx context.Context, repo string, dgst digest.Digest) error {
+	return fmt.Errorf("deleting digests is not supported for gitlab")
+}
+
+func (g *gitlabBackend) Referrers(ctx context.Context, repo string, dgst digest.Digest) ([]digest.Digest, error) {
+	return nil, nil
+}
+
+func (g *gitlabBackend) Manifest(ctx context.Context, repo string, dgst digest.Digest) ([]byte, string, error) {
+	return nil, "", fmt.Errorf("manifests are not available for gitlab")
+}
+
+func (g *gitlabBackend) Blob(ctx context.Context, repo string, dgst digest.Digest) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("blobs are not available for gitlab")
+}
+
+func (g *gitlabBackend) Capabilities() capabilities {
+	return capabilities{TagDelete: true, PushTime: true}
+}
+
+// gitlabTransport authenticates with a private token and follows the rate
+// limit headers of gitlab. If no request is left it waits for the reset and
+// requests answered with 429 are repeated after Retry-After.
+type gitlabTransport struct {
+	token     string
+	Transport http.RoundTripper
+
+	sync.Mutex
+	resume time.Time
+}
+
+// rateLimitWait returns how long to wait after resp, zero if no wait is needed
+func rateLimitWait(resp *http.Response, now time.Time) time.Duration {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	} else if resp.Header.Get("RateLimit-Remaining") != "0" {
+		return 0
+	}
+
+	if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		if wait := time.Unix(reset, 0).Sub(now); wait > 0 {
+			return wait
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return time.Second
+	}
+	return 0
+}
+
+func (t *gitlabTransport) sleep(ctx context.Context) error {
+	t.Lock()
+	wait := time.Until(t.resume)
+	t.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *gitlabTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		if err := t.sleep(req.Context()); err != nil {
+			return nil, err
+		}
+
+		// the requests have no body, so they can be sent again
+		r := new(http.Request)
+		*r = *req
+		r.Header = make(http.Header)
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set("PRIVATE-TOKEN", t.token)
+
+		resp, err := t.Transport.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if wait := rateLimitWait(resp, time.Now()); wait > 0 {
+			t.Lock()
+			if resume := time.Now().Add(wait); resume.After(t.resume) {
+				t.resume = resume
+			}
+			t.Unlock()
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || retry == gitlabRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,245 @@
+// docker-unregstriy-untagger :- tests for the gitlab backend
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGitlab implements the container registry API of gitlab. The tag list
+// has no details like older gitlab versions.
+type fakeGitlab struct {
+	sync.Mutex
+	projects     map[string]int
+	repositories []gitlabRepository
+	tags         map[int]map[string]gitlabTag
+	// tooMany is the number of requests that are answered with 429
+	tooMany  int
+	requests []string
+}
+
+func newFakeGitlab() *fakeGitlab {
+	return &fakeGitlab{projects: make(map[string]int), tags: make(map[int]map[string]gitlabTag)}
+}
+
+func (f *fakeGitlab) addTag(project, image, tag string, created time.Time) {
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.projects[project]; !ok {
+		f.projects[project] = len(f.projects) + 1
+	}
+	path := strings.Trim(project+"/"+image, "/")
+	id := -1
+	for _, r := range f.repositories {
+		if r.Path == path {
+			id = r.ID
+		}
+	}
+	if id < 0 {
+		id = len(f.repositories) + 10
+		f.repositories = append(f.repositories, gitlabRepository{ID: id, Path: path, ProjectID: f.projects[project]})
+		f.tags[id] = make(map[string]gitlabTag)
+	}
+	f.tags[id][tag] = gitlabTag{Name: tag, Digest: digest.FromString(path + tag), CreatedAt: created}
+}
+
+func (f *fakeGitlab) tagsOf(id int) []string {
+	f.Lock()
+	defer f.Unlock()
+	ret := make([]string, 0)
+	for tag := range f.tags[id] {
+		ret = append(ret, tag)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// gitlabPage writes the part of items requested by page and per_page
+func gitlabPage(w http.ResponseWriter, req *http.Request, n int, item func(int) interface{}) {
+	p, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	size, _ := strconv.Atoi(req.URL.Query().Get("per_page"))
+	items := make([]interface{}, 0)
+	for i := (p - 1) * size; i < p*size && i < n; i++ {
+		items = append(items, item(i))
+	}
+	if p*size < n {
+		w.Header().Set("X-Next-Page", strconv.Itoa(p+1))
+	}
+	json.NewEncoder(w).Encode(items)
+}
+
+func (f *fakeGitlab) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.RequestURI())
+
+	if req.Header.Get("PRIVATE-TOKEN") != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if f.tooMany > 0 {
+		f.tooMany--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), gitlabAPI+"/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "version":
+		json.NewEncoder(w).Encode(map[string]string{"version": "13.0.0"})
+
+	case len(parts) == 4 && parts[0] == "projects":
+		project, _ := url.PathUnescape(parts[1])
+		id, ok := f.projects[project]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		repos := make([]gitlabRepository, 0)
+		for _, r := range f.repositories {
+			if r.ProjectID == id {
+				repos = append(repos, r)
+			}
+		}
+		gitlabPage(w, req, len(repos), func(i int) interface{} { return repos[i] })
+
+	case len(parts) >= 6 && parts[0] == "projects" && parts[5] == "tags":
+		id, _ := strconv.Atoi(parts[4])
+		tags, ok := f.tags[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if len(parts) == 6 {
+			names := make([]string, 0)
+			for name := range tags {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			gitlabPage(w, req, len(names), func(i int) interface{} { return map[string]string{"name": names[i]} })
+			return
+		}
+
+		name, _ := url.PathUnescape(parts[6])
+		tag, ok := tags[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == "DELETE" {
+			delete(tags, name)
+			return
+		}
+		json.NewEncoder(w).Encode(tag)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func startFakeGitlab(f *fakeGitlab) (*httptest.Server, *gitlabClient) {
+	srv := httptest.NewServer(f)
+	return srv, newGitlabClient(srv.URL, "token", http.DefaultTransport)
+}
+
+func TestRateLimitWait(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		status int
+		header map[string]string
+		wait   time.Duration
+	}{
+		{http.StatusOK, map[string]string{}, 0},
+		{http.StatusOK, map[string]string{"RateLimit-Remaining": "10", "RateLimit-Reset": "1060"}, 0},
+		{http.StatusOK, map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "1060"}, time.Minute},
+		{http.StatusOK, map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "900"}, 0},
+		{http.StatusTooManyRequests, map[string]string{"Retry-After": "5"}, 5 * time.Second},
+		{http.StatusTooManyRequests, map[string]string{"RateLimit-Reset": "1030"}, 30 * time.Second},
+		{http.StatusTooManyRequests, map[string]string{}, time.Second},
+	}
+
+	for i, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: make(http.Header)}
+		for k, v := range tt.header {
+			resp.Header.Set(k, v)
+		}
+		assert.Equal(t, tt.wait, rateLimitWait(resp, now), "TestRateLimitWait "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestGitlabTags(t *testing.T) {
+	f := newFakeGitlab()
+	srv, gitlab := startFakeGitlab(f)
+	defer srv.Close()
+
+	created := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < gitlabPerPage+20; i++ {
+		f.addTag("group/project", "app", "build_"+strconv.Itoa(i), created)
+	}
+	f.addTag("group/project", "", "latest", created)
+	f.tooMany = 2
+
+	tags, err := gitlab.tags(context.Background(), "group/project/app")
+	assert.NoError(t, err)
+	assert.Len(t, tags, gitlabPerPage+20)
+	for _, tag := range tags {
+		assert.Equal(t, created, tag.CreatedAt.UTC())
+		assert.Equal(t, digest.FromString("group/project/app"+tag.Name), tag.Digest)
+	}
+
+	// the repository of the project itself has no image name
+	tags, err = gitlab.tags(context.Background(), "group/project")
+	assert.NoError(t, err)
+	assert.Len(t, tags, 1)
+
+	_, err = gitlab.tags(context.Background(), "group/other")
+	assert.Error(t, err)
+}
+
+func TestCleanGitlabRepository(t *testing.T) {
+	f := newFakeGitlab()
+	srv, gitlab := startFakeGitlab(f)
+	defer srv.Close()
+
+	oldRules := rules
+	defer func() { rules = oldRules }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+		MinAge:             7,
+	}
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	f.addTag("group/project", "app", "build_1", old)
+	f.addTag("group/project", "app", "build_2", time.Now())
+	f.addTag("group/project", "app", "build_3", old)
+	f.addTag("group/project", "app", "release_1", old)
+	f.addTag("group/project", "app", "invalid", old)
+
+	removed, held, err := cleanRepository(context.Background(), context.Background(), &gitlabBackend{client: gitlab}, "group/project/app", &runSummary{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, 0, held)
+	assert.Equal(t, []string{"build_2", "build_3", "release_1"}, f.tagsOf(10))
+}
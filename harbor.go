@@ -0,0 +1,192 @@
+// docker-unregstriy-untagger :- harbor backend
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	typeRegistry = "registry"
+	typeHarbor   = "harbor"
+
+	harborAPI      = "/api/v2.0"
+	harborPageSize = 100
+)
+
+type harborTag struct {
+	Name     string    `json:"name"`
+	PushTime time.Time `json:"push_time"`
+	PullTime time.Time `json:"pull_time"`
+}
+
+// harborArtifact is a manifest of a harbor repository with all its tags
+type harborArtifact struct {
+	Digest   digest.Digest `json:"digest"`
+	PushTime time.Time     `json:"push_time"`
+	PullTime time.Time     `json:"pull_time"`
+	Tags     []harborTag   `json:"tags"`
+}
+
+// harborRepositoryPath returns the API path of repo. The first path element
+// is the project, the rest is the repository name which has to be encoded
+// twice if it contains a slash.
+func harborRepositoryPath(repo string) (string, error) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("harbor repository %q needs a project", repo)
+	}
+	return harborAPI + "/projects/" + url.PathEscape(parts[0]) +
+		"/repositories/" + url.PathEscape(url.PathEscape(parts[1])), nil
+}
+
+// harborRequest sends a request to the harbor API, the registry client adds
+// the credentials and turns error codes into errors
+func harborRequest(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, hub.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	return hub.Client.Do(req.WithContext(ctx))
+}
+
+// harborPages requests every page of path, decode returns the number of
+// items of a page
+func harborPages(ctx context.Context, path string, query url.Values, decode func(io.Reader) (int, error)) error {
+	seen := 0
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		query.Set("page_size", strconv.Itoa(harborPageSize))
+		resp, err := harborRequest(ctx, "GET", path+"?"+query.Encode())
+		if err != nil {
+			return err
+		}
+
+		n, err := decode(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		seen += n
+
+		total, err := strconv.Atoi(resp.Header.Get("X-Total-Count"))
+		if err != nil {
+			total = -1
+		}
+		if n < harborPageSize || seen == total {
+			return nil
+		}
+	}
+}
+
+// harborArtifacts lists all artifacts of repo with their tags
+func harborArtifacts(ctx context.Context, repo string) ([]harborArtifact, error) {
+	path, err := harborRepositoryPath(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := make([]harborArtifact, 0)
+	err = harborPages(ctx, path+"/artifacts", url.Values{"with_tag": []string{"true"}}, func(body io.Reader) (int, error) {
+		page := make([]harborArtifact, 0)
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return 0, err
+		}
+		artifacts = append(artifacts, page...)
+		return len(page), nil
+	})
+	return artifacts, err
+}
+
+// harborBackend lists tags with the artifact API of harbor and removes single
+// tags. Manifests and configs are read with the registry API of harbor.
+type harborBackend struct {
+	registryBackend
+}
+
+func (h *harborBackend) Repositories(ctx context.Context) ([]string, error) {
+	repos := make([]string, 0)
+	err := harborPages(ctx, harborAPI+"/repositories", url.Values{}, func(body io.Reader) (int, error) {
+		page := make([]struct {
+			Name string `json:"name"`
+		}, 0)
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return 0, err
+		}
+		for _, repo := range page {
+			repos = append(repos, repo.Name)
+		}
+		return len(page), nil
+	})
+	return repos, err
+}
+
+// Tags returns every tag of the artifacts with its digest and push time
+func (h *harborBackend) Tags(ctx context.Context, repo string) ([]tagInfo, error) {
+	artifacts, err := harborArtifacts(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]tagInfo, 0)
+	for _, artifact := range artifacts {
+		for _, tag := range artifact.Tags {
+			tags = append(tags, tagInfo{Name: tag.Name, Digest: artifact.Digest, Created: tag.PushTime})
+		}
+	}
+	return tags, nil
+}
+
+// DeleteTag removes a single tag, the artifact stays even if it has no tags
+// anymore
+func (h *harborBackend) DeleteTag(ctx context.Context, repo, tag string, dgst digest.Digest) error {
+	path, err := harborRepositoryPath(repo)
+	if err != nil {
+		return err
+	}
+
+	resp, err := harborRequest(ctx, "DELETE", path+"/artifacts/"+dgst.String()+"/tags/"+url.PathEscape(tag))
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// DeleteDigest removes an artifact with all of its tags
+func (h *harborBackend) DeleteDigest(ctx context.Context, repo string, dgst digest.Digest) error {
+	path, err := harborRepositoryPath(repo)
+	if err != nil {
+		return err
+	}
+
+	resp, err := harborRequest(ctx, "DELETE", path+"/artifacts/"+dgst.String())
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// Referrers returns nothing, harbor removes the accessories of an artifact
+// like signatures itself
+func (h *harborBackend) Referrers(ctx context.Context, repo string, dgst digest.Digest) ([]digest.Digest, error) {
+	return nil, nil
+}
+
+func (h *harborBackend) Capabilities() capabilities {
+	return capabilities{TagDelete: true, PushTime: true, Manifests: true}
+}
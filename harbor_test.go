@@ -0,0 +1,172 @@
+// docker-unregstriy-untagger :- tests for the harbor backend
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHarbor serves the artifact API of harbor on top of the fake registry
+type fakeHarbor struct {
+	*fakeRegistry
+	pushed map[string]time.Time
+}
+
+func newFakeHarbor() *fakeHarbor {
+	return &fakeHarbor{fakeRegistry: newFakeRegistry(), pushed: make(map[string]time.Time)}
+}
+
+func (f *fakeHarbor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, harborAPI+"/projects/") {
+		f.fakeRegistry.ServeHTTP(w, req)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path)
+
+	// projects/<project>/repositories/<name>/artifacts[/<digest>/tags/<tag>]
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, harborAPI+"/"), "/")
+	if len(parts) < 5 || parts[2] != "repositories" || parts[4] != "artifacts" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name, err := url.PathUnescape(parts[3])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	repoName := parts[1] + "/" + name
+	r := f.repo(repoName)
+
+	if req.Method == "DELETE" && len(parts) == 8 {
+		if r.tags[parts[7]] != digest.Digest(parts[5]) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(r.tags, parts[7])
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	byDigest := make(map[digest.Digest]*harborArtifact)
+	for tag, d := range r.tags {
+		if byDigest[d] == nil {
+			byDigest[d] = &harborArtifact{Digest: d}
+		}
+		byDigest[d].Tags = append(byDigest[d].Tags, harborTag{Name: tag, PushTime: f.pushed[repoName+":"+tag]})
+	}
+	artifacts := make([]harborArtifact, 0)
+	for _, a := range byDigest {
+		artifacts = append(artifacts, *a)
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Digest < artifacts[j].Digest })
+
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	size, _ := strconv.Atoi(req.URL.Query().Get("page_size"))
+	start, end := (page-1)*size, page*size
+	if start > len(artifacts) {
+		start = len(artifacts)
+	}
+	if end > len(artifacts) {
+		end = len(artifacts)
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(artifacts)))
+	json.NewEncoder(w).Encode(artifacts[start:end])
+}
+
+func (f *fakeHarbor) push(repo string, i int, pushed time.Time, tags ...string) {
+	payload := []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `","config":{"digest":"sha256:0` + strconv.Itoa(i) + `"}}`)
+	f.addManifest(repo, schema2.MediaTypeManifest, payload, tags...)
+	for _, tag := range tags {
+		f.pushed[repo+":"+tag] = pushed
+	}
+}
+
+func TestHarborRepositoryPath(t *testing.T) {
+	tests := []struct {
+		repo string
+		path string
+		err  bool
+	}{
+		{"library/app", harborAPI + "/projects/library/repositories/app", false},
+		{"library/team/app", harborAPI + "/projects/library/repositories/team%252Fapp", false},
+		{"app", "", true},
+	}
+
+	for i, tt := range tests {
+		path, err := harborRepositoryPath(tt.repo)
+		assert.Equal(t, tt.path, path, "TestHarborRepositoryPath "+strconv.Itoa(i+1)+" values should be equal")
+		assert.Equal(t, tt.err, err != nil, "TestHarborRepositoryPath "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestHarborArtifacts(t *testing.T) {
+	f := newFakeHarbor()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	for i := 0; i < harborPageSize+20; i++ {
+		f.push("library/app", i, time.Now(), "build_"+strconv.Itoa(i))
+	}
+
+	artifacts, err := harborArtifacts(context.Background(), "library/app")
+	assert.NoError(t, err)
+	assert.Len(t, artifacts, harborPageSize+20)
+
+	tags, err := (&harborBackend{}).Tags(context.Background(), "library/app")
+	assert.NoError(t, err)
+	assert.Len(t, tags, harborPageSize+20)
+	for _, tag := range tags {
+		assert.Equal(t, f.repo("library/app").tags[tag.Name], tag.Digest)
+	}
+}
+
+func TestCleanHarborRepository(t *testing.T) {
+	f := newFakeHarbor()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	oldRules := rules
+	defer func() { rules = oldRules }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+		MinAge:             7,
+	}
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	f.push("library/team/app", 1, old, "build_1", "release_1")
+	f.push("library/team/app", 2, time.Now(), "build_2")
+	f.push("library/team/app", 3, old, "build_3")
+	f.push("library/team/app", 4, old, "invalid")
+
+	// build_1 goes although release_1 shares its artifact, build_2 is too young
+	removed, held, err := cleanRepository(context.Background(), context.Background(), &harborBackend{}, "library/team/app", &runSummary{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, 0, held)
+	assert.Equal(t, []string{"build_2", "build_3", "release_1"}, f.tagsOf("library/team/app"))
+
+	_, err = harborArtifacts(context.Background(), "app")
+	assert.Error(t, err)
+}
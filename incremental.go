@@ -0,0 +1,137 @@
+// docker-unregstriy-untagger :- incremental runs
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUnchanged = errors.New("unchanged since the last run")
+
+// repoState is the outcome of the last complete run of a repository
+type repoState struct {
+	Fingerprint string    `json:"fingerprint"`
+	Kept        []string  `json:"kept"`
+	Removed     []string  `json:"removed"`
+	Checked     time.Time `json:"checked"`
+	// RecheckAfter is the first time a kept tag could be removed because it
+	// gets old enough or leaves the quarantine
+	RecheckAfter time.Time `json:"recheckAfter"`
+}
+
+// incrementalState allows to skip repositories whose tags did not change
+type incrementalState struct {
+	sync.Mutex
+	Repositories map[string]repoState `json:"repositories"`
+}
+
+func newIncrementalState() *incrementalState {
+	return &incrementalState{Repositories: make(map[string]repoState)}
+}
+
+// loadIncrementalState reads the state file, a missing file is an empty state
+func loadIncrementalState(fileName string) (*incrementalState, error) {
+	s := newIncrementalState()
+
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Repositories == nil {
+		s.Repositories = make(map[string]repoState)
+	}
+	return s, nil
+}
+
+func (s *incrementalState) save(fileName string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, b, 0644)
+}
+
+// fingerprint hashes the tag list together with the rules it was evaluated with
+func fingerprint(tags []string, rulesHash string) string {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	h.Write([]byte(rulesHash))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// unchanged returns true if the last run already evaluated the same tags and
+// no age threshold was crossed since then
+func (s *incrementalState) unchanged(repo, fp string, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	state, ok := s.Repositories[repo]
+	if !ok || state.Fingerprint != fp {
+		return false
+	}
+	return state.RecheckAfter.IsZero() || now.Before(state.RecheckAfter)
+}
+
+// record stores the decisions of a complete run, the fingerprint is taken of
+// the kept tags since that is what the next run will find
+func (s *incrementalState) record(repo string, kept, removed []string, recheckAfter, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	sort.Strings(kept)
+	sort.Strings(removed)
+	s.Repositories[repo] = repoState{
+		Fingerprint:  fingerprint(kept, rulesHash),
+		Kept:         kept,
+		Removed:      removed,
+		Checked:      now,
+		RecheckAfter: recheckAfter,
+	}
+}
+
+// recheckTime keeps the earliest time a decision could change
+type recheckTime struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (r *recheckTime) update(t time.Time) {
+	r.Lock()
+	if r.t.IsZero() || t.Before(r.t) {
+		r.t = t
+	}
+	r.Unlock()
+}
+
+func (r *recheckTime) get() time.Time {
+	r.Lock()
+	defer r.Unlock()
+	return r.t
+}
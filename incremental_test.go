@@ -0,0 +1,107 @@
+// docker-unregstriy-untagger :- tests for incremental runs
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	assert.Equal(t, fingerprint([]string{"a", "b"}, "r1"), fingerprint([]string{"b", "a"}, "r1"))
+	assert.NotEqual(t, fingerprint([]string{"a", "b"}, "r1"), fingerprint([]string{"a", "b"}, "r2"))
+	assert.NotEqual(t, fingerprint([]string{"a", "b"}, "r1"), fingerprint([]string{"a"}, "r1"))
+}
+
+func TestIncrementalStateUnchanged(t *testing.T) {
+	now := time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC)
+	fp := fingerprint([]string{"build_1"}, rulesHash)
+
+	var tests = []struct {
+		inState *repoState
+		inFP    string
+		out     bool
+	}{
+		{nil, fp, false},
+		{&repoState{Fingerprint: fp}, fp, true},
+		{&repoState{Fingerprint: fp}, fingerprint([]string{"build_2"}, rulesHash), false},
+		{&repoState{Fingerprint: fp, RecheckAfter: now.Add(time.Hour)}, fp, true},
+		{&repoState{Fingerprint: fp, RecheckAfter: now.Add(-time.Hour)}, fp, false},
+	}
+	for i, tt := range tests {
+		s := newIncrementalState()
+		if tt.inState != nil {
+			s.Repositories["repo"] = *tt.inState
+		}
+		assert.Equal(t, tt.out, s.unchanged("repo", tt.inFP, now), "TestIncrementalStateUnchanged "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestIncrementalStateSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "state.json")
+
+	s, err := loadIncrementalState(fileName)
+	assert.NoError(t, err)
+	assert.Empty(t, s.Repositories)
+
+	now := time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC)
+	s.record("repo", []string{"b", "a"}, []string{"c"}, time.Time{}, now)
+	assert.NoError(t, s.save(fileName))
+
+	s, err = loadIncrementalState(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, repoState{
+		Fingerprint: fingerprint([]string{"a", "b"}, rulesHash),
+		Kept:        []string{"a", "b"},
+		Removed:     []string{"c"},
+		Checked:     now,
+	}, s.Repositories["repo"])
+}
+
+func TestCleanRepositoryIncremental(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	oldRules, oldIncremental := rules, incremental
+	defer func() { rules, incremental = oldRules, oldIncremental }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+	}
+	incremental = newIncrementalState()
+
+	for i := 1; i <= 2; i++ {
+		payload := []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `","config":{"digest":"sha256:0` + strconv.Itoa(i) + `"}}`)
+		f.addManifest("app", schema2.MediaTypeManifest, payload, "build_"+strconv.Itoa(i))
+	}
+
+	removed, _, err := cleanRepository(context.Background(), context.Background(), &registryBackend{}, "app", &runSummary{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	_, _, err = cleanRepository(context.Background(), context.Background(), &registryBackend{}, "app", &runSummary{})
+	assert.Equal(t, errUnchanged, err)
+
+	fullScan = true
+	defer func() { fullScan = false }()
+	_, _, err = cleanRepository(context.Background(), context.Background(), &registryBackend{}, "app", &runSummary{})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,457 @@
+// docker-unregstriy-untagger :- rules linter
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v1"
+)
+
+// lintSamples limits the tags generated from buildSortRegex
+const lintSamples = 16
+
+// lintIssue is a problem of a rules file at a line, line 0 is the whole file
+type lintIssue struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (i lintIssue) String() string {
+	if i.Line == 0 {
+		return fmt.Sprintf("%s: %s", i.File, i.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", i.File, i.Line, i.Message)
+}
+
+var (
+	// characterClassGroup finds named groups written inside a character
+	// class like ([?P<flavor>...]), the brackets make it a set of characters
+	characterClassGroup = regexp.MustCompile(`\[\^?\?P?<(\w+)>`)
+	// unmarkedGroup finds named groups without the question mark
+	unmarkedGroup = regexp.MustCompile(`\(P<(\w+)>`)
+)
+
+// yamlLines locates keys and list items in a yaml file, the vendored yaml
+// parser does not report positions
+type yamlLines []string
+
+// key returns the line of a top level key
+func (y yamlLines) key(name string) int {
+	for i, line := range y {
+		if strings.HasPrefix(line, name+":") {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// item returns the line of the n-th list item below a top level key or the
+// line of the key for inline lists
+func (y yamlLines) item(name string, n int) int {
+	start := y.key(name)
+	if start == 0 {
+		return 0
+	}
+	for i := start; i < len(y); i++ {
+		line := y[i]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "-") {
+			break
+		}
+		if strings.HasPrefix(trimmed, "-") {
+			if n == 0 {
+				return i + 1
+			}
+			n--
+		}
+	}
+	return start
+}
+
+// rulesKeys returns the keys rules.yml may have
+func rulesKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(rule{})
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("yaml"); key != "" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// lintRulesFile reads a rules file and lints it
+func lintRulesFile(fileName string) ([]lintIssue, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("rules file %s is missing: %s", fileName, err)
+	}
+	return lintRules(fileName, b), nil
+}
+
+// lintRules reports everything in a rules file that makes the rules behave
+// differently than they read: regexes that do not compile, unknown keys,
+// build tags that are no valid tags, groups of buildSortRegex that are not
+// used as intended and negative numbers.
+func lintRules(fileName string, b []byte) []lintIssue {
+	issues := make([]lintIssue, 0)
+	lines := yamlLines(strings.Split(string(b), "\n"))
+	report := func(line int, format string, args ...interface{}) {
+		issues = append(issues, lintIssue{File: fileName, Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	r := rule{}
+	if err := yaml.Unmarshal(b, &r); err != nil {
+		report(0, "malformed: %s", err)
+		return issues
+	}
+
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(b, &raw); err == nil {
+		keys := rulesKeys()
+		unknown := make([]string, 0)
+		for key := range raw {
+			if !keys[key] {
+				unknown = append(unknown, key)
+			}
+		}
+		sort.Strings(unknown)
+		for _, key := range unknown {
+			report(lines.key(key), "unknown key %s", key)
+		}
+	}
+
+	if len(r.Repositories) == 0 {
+		report(lines.key("repositories"), "atleast one repositories needes to be added")
+	}
+	if len(r.ValidTags) == 0 {
+		report(lines.key("validTags"), "atleast one tag regex needs to be added")
+	}
+
+	valid := make([]*regexp.Regexp, 0, len(r.ValidTags))
+	for i, tag := range r.ValidTags {
+		regex, err := regexp.Compile(tag)
+		if err != nil {
+			report(lines.item("validTags", i), "validTags regexp %q isnt valid (%s)", tag, err)
+			continue
+		}
+		lintGroupNames(tag, func(format string, args ...interface{}) {
+			report(lines.item("validTags", i), format, args...)
+		})
+		valid = append(valid, regex)
+	}
+
+	if r.KeepNewestBySort < 0 {
+		report(lines.key("keepBuilds"), "keepBuilds is negative (%d), no build is ever removed", r.KeepNewestBySort)
+	}
+	if r.QuarantineDays < 0 {
+		report(lines.key("quarantineDays"), "quarantineDays is negative (%d)", r.QuarantineDays)
+	}
+
+	if r.SortAndFilter != "" {
+		line := lines.key("buildSortRegex")
+		lintBuildSortRegex(r.SortAndFilter, valid, len(valid) == len(r.ValidTags), func(format string, args ...interface{}) {
+			report(line, format, args...)
+		})
+	}
+
+	for i, tag := range r.ArchiveTags {
+		if _, err := regexp.Compile(tag); err != nil {
+			report(lines.item("archiveTags", i), "archiveTags regexp %q isnt valid (%s)", tag, err)
+		}
+	}
+	switch r.ArchiveFormat {
+	case "", archiveOCI, archiveDocker:
+	default:
+		report(lines.key("archiveFormat"), "archive format %s is unknown, use %s or %s", r.ArchiveFormat, archiveOCI, archiveDocker)
+	}
+	return issues
+}
+
+// lintGroupNames reports named groups that are written wrongly and
+// therefore match literal characters
+func lintGroupNames(expr string, report func(string, ...interface{})) {
+	for _, m := range characterClassGroup.FindAllStringSubmatch(expr, -1) {
+		report("%q is a character class, not a named group, write (?P<%s>...)", m[0], m[1])
+	}
+	for _, m := range unmarkedGroup.FindAllStringSubmatch(expr, -1) {
+		report("%q is no named group, write (?P<%s>...)", m[0], m[1])
+	}
+}
+
+// lintBuildSortRegex checks the groups of buildSortRegex like getFlavor uses
+// them and that the tags it matches are valid tags. checkValid is false if
+// some validTags do not compile.
+func lintBuildSortRegex(expr string, valid []*regexp.Regexp, checkValid bool, report func(string, ...interface{})) {
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		report("buildSortRegex isnt valid (%s)", err)
+		return
+	}
+	lintGroupNames(expr, report)
+
+	flavorID, buildNrID := 1, 2
+	named := 0
+	switch n := regex.NumSubexp(); {
+	case n == 0:
+		report("buildSortRegex has no group for the build number, no tag is treated as build")
+		return
+	case n == 1:
+		flavorID, buildNrID = 0, 1
+	default:
+		for i, name := range regex.SubexpNames() {
+			switch name {
+			case "":
+			case "flavor":
+				flavorID = i
+				named++
+			case "buildnr":
+				buildNrID = i
+				named++
+			default:
+				report("buildSortRegex has the unknown group name %s, only flavor and buildnr are used", name)
+			}
+		}
+		if n > 2 && named < 2 {
+			report("buildSortRegex has %d groups, name the flavor and build number with (?P<flavor>...) and (?P<buildnr>...) or use (?:...) for the others", n)
+		}
+		if flavorID == buildNrID {
+			report("flavor and build number of buildSortRegex are the same group %d", flavorID)
+			return
+		}
+	}
+
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return
+	}
+	samples := regexSamples(re.Simplify(), lintSamples)
+	if len(samples) == 0 {
+		return
+	}
+
+	for _, sample := range samples {
+		sub := regex.FindStringSubmatch(sample)
+		if sub == nil {
+			continue
+		}
+		if _, err := strconv.Atoi(sub[buildNrID]); err != nil {
+			report("the build number group %d of buildSortRegex matches %q in %q, which is no number", buildNrID, sub[buildNrID], sample)
+			return
+		}
+	}
+
+	if !checkValid {
+		return
+	}
+	for _, regex := range valid {
+		if overlap, ok := regexOverlap(expr, regex.String()); overlap || !ok {
+			return
+		}
+	}
+	report("builds like %q match none of validTags, they are removed as invalid tags", samples[0])
+}
+
+// regexOverlap tells if a string exists that both regexes match somewhere,
+// like getFlavor and validTag use them. The compiled programs are walked
+// together and both must consume the same runes, so this is exact and not
+// limited to samples. Word boundaries, line anchors and case folding are
+// assumed to always match, this can only find an overlap that does not
+// exist, never miss one. ok is false if an expression does not compile.
+func regexOverlap(a, b string) (overlap, ok bool) {
+	progA, err := unanchoredProg(a)
+	if err != nil {
+		return false, false
+	}
+	progB, err := unanchoredProg(b)
+	if err != nil {
+		return false, false
+	}
+
+	type state struct {
+		a, b         uint32
+		start, ended bool
+	}
+	first := state{a: uint32(progA.Start), b: uint32(progB.Start), start: true}
+	seen := map[state]bool{first: true}
+	queue := []state{first}
+	push := func(st state) {
+		if !seen[st] {
+			seen[st] = true
+			queue = append(queue, st)
+		}
+	}
+
+	for len(queue) != 0 {
+		st := queue[0]
+		queue = queue[1:]
+		instA, instB := &progA.Inst[st.a], &progB.Inst[st.b]
+		if instA.Op == syntax.InstMatch && instB.Op == syntax.InstMatch {
+			return true, true
+		}
+
+		// one program moves on without consuming a rune
+		for side, inst := range []*syntax.Inst{instA, instB} {
+			for _, next := range emptyMoves(inst, st.start) {
+				moved := st
+				if inst.Op == syntax.InstEmptyWidth && syntax.EmptyOp(inst.Arg)&syntax.EmptyEndText != 0 {
+					moved.ended = true
+				}
+				if side == 0 {
+					moved.a = next
+				} else {
+					moved.b = next
+				}
+				push(moved)
+			}
+		}
+
+		// both programs consume the same rune
+		if !st.ended && runesOverlap(instA, instB) {
+			push(state{a: instA.Out, b: instB.Out})
+		}
+	}
+	return false, true
+}
+
+// unanchoredProg compiles expr so that it matches the whole string but may
+// start and end anywhere in it, like an unanchored search
+func unanchoredProg(expr string) (*syntax.Prog, error) {
+	re, err := syntax.Parse(`(?s:.*)(?:`+expr+`)(?s:.*)`, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	return syntax.Compile(re.Simplify())
+}
+
+// emptyMoves returns where inst continues without consuming a rune, the
+// beginning of the text only matches before the first rune
+func emptyMoves(inst *syntax.Inst, start bool) []uint32 {
+	switch inst.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		return []uint32{inst.Out, inst.Arg}
+	case syntax.InstNop, syntax.InstCapture:
+		return []uint32{inst.Out}
+	case syntax.InstEmptyWidth:
+		if syntax.EmptyOp(inst.Arg)&syntax.EmptyBeginText != 0 && !start {
+			return nil
+		}
+		return []uint32{inst.Out}
+	}
+	return nil
+}
+
+// runesOverlap tells if a rune exists that both instructions consume
+func runesOverlap(a, b *syntax.Inst) bool {
+	rangesA, okA := runeRanges(a)
+	rangesB, okB := runeRanges(b)
+	if !okA || !okB {
+		return false
+	}
+	for i := 0; i+1 < len(rangesA); i += 2 {
+		for j := 0; j+1 < len(rangesB); j += 2 {
+			if rangesA[i] <= rangesB[j+1] && rangesB[j] <= rangesA[i+1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runeRanges returns the runes inst consumes as pairs of lowest and highest
+// rune, case folding matches every rune. ok is false if inst consumes none.
+func runeRanges(inst *syntax.Inst) ([]rune, bool) {
+	switch inst.Op {
+	case syntax.InstRune:
+		if syntax.Flags(inst.Arg)&syntax.FoldCase != 0 {
+			return []rune{0, unicode.MaxRune}, true
+		}
+		if len(inst.Rune) == 1 {
+			return []rune{inst.Rune[0], inst.Rune[0]}, true
+		}
+		return inst.Rune, true
+	case syntax.InstRune1:
+		return []rune{inst.Rune[0], inst.Rune[0]}, true
+	case syntax.InstRuneAny:
+		return []rune{0, unicode.MaxRune}, true
+	case syntax.InstRuneAnyNotNL:
+		return []rune{0, '\n' - 1, '\n' + 1, unicode.MaxRune}, true
+	}
+	return nil, false
+}
+
+// regexSamples returns up to max strings re matches. Repetitions are as
+// short as possible and character classes use their first character.
+func regexSamples(re *syntax.Regexp, max int) []string {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return nil
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return nil
+		}
+		return []string{string(re.Rune[0])}
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return []string{"a"}
+	case syntax.OpCapture, syntax.OpPlus:
+		return regexSamples(re.Sub[0], max)
+	case syntax.OpStar, syntax.OpQuest:
+		return []string{""}
+	case syntax.OpRepeat:
+		ret := []string{""}
+		for i := 0; i < re.Min; i++ {
+			ret = concatSamples(ret, regexSamples(re.Sub[0], max), max)
+		}
+		return ret
+	case syntax.OpConcat:
+		ret := []string{""}
+		for _, sub := range re.Sub {
+			ret = concatSamples(ret, regexSamples(sub, max), max)
+		}
+		return ret
+	case syntax.OpAlternate:
+		ret := make([]string, 0)
+		for _, sub := range re.Sub {
+			ret = append(ret, regexSamples(sub, max)...)
+			if len(ret) >= max {
+				return ret[:max]
+			}
+		}
+		return ret
+	default:
+		// empty matches, anchors and word boundaries
+		return []string{""}
+	}
+}
+
+func concatSamples(prefixes, suffixes []string, max int) []string {
+	ret := make([]string, 0)
+	for _, p := range prefixes {
+		for _, s := range suffixes {
+			if len(ret) == max {
+				return ret
+			}
+			ret = append(ret, p+s)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,138 @@
+// docker-unregstriy-untagger :- tests for the rules linter
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLintRules(t *testing.T) {
+	var tests = []struct {
+		rules  string
+		issues []string
+	}{
+		{
+			"repositories:\n  - app\nvalidTags:\n  - '[A-Za-z]+_release_[0-9]+'\n  - '[A-Za-z]+_build_[0-9]+'\nkeepBuilds: 2\nbuildSortRegex: ([A-Za-z]+)_build_([0-9]+)\n",
+			[]string{},
+		},
+		{
+			// builds are never valid tags
+			"repositories: [app]\nvalidTags:\n  - '^release_[0-9]+$'\nkeepBuilds: 2\nbuildSortRegex: build_([0-9]+)\n",
+			[]string{`rules.yml:5: builds like "build_0" match none of validTags`},
+		},
+		{
+			"repositories: [app]\nvalidTags:\n  - '[A-Za-z]+_[0-9]+'\nbuildSortRegex: ([?P<flavor>A-Za-z]+)_([?P<buildnr>0-9]+)\n",
+			[]string{
+				`rules.yml:4: "[?P<flavor>" is a character class, not a named group, write (?P<flavor>...)`,
+				`rules.yml:4: "[?P<buildnr>" is a character class, not a named group, write (?P<buildnr>...)`,
+			},
+		},
+		{
+			// the shortest builds are no valid tags, but longer ones are
+			"repositories: [app]\nvalidTags:\n  - '^build_[1-9][0-9]*$'\nbuildSortRegex: build_([0-9]+)\n",
+			[]string{},
+		},
+		{
+			"repositories: [app]\nvalidTags:\n  - '^centos[5-7]_build_[0-9]+$'\nbuildSortRegex: ([a-z]+[0-9])_build_([0-9]+)\n",
+			[]string{},
+		},
+		{
+			"repositories: [app]\nvalidTags:\n  - '^v[0-9]+\\.[0-9]+\\.[0-9]+-build[0-9]+$'\nbuildSortRegex: build([0-9]+)$\n",
+			[]string{},
+		},
+		{
+			"repositories: [app]\nvalidTags:\n  - '.*'\nbuildSortRegex: (P<flavor>[a-z]+)_([0-9]+)\n",
+			[]string{`rules.yml:4: "(P<flavor>" is no named group, write (?P<flavor>...)`},
+		},
+		{
+			"repositories: [app]\nvalidTags:\n  - '.*'\nbuildSortRegex: build_[0-9]+\n",
+			[]string{"rules.yml:4: buildSortRegex has no group for the build number"},
+		},
+		{
+			"repositories: [app]\nvalidTags:\n  - '.*'\nbuildSortRegex: ([a-z]+)_([a-z]+)_([0-9]+)\n",
+			[]string{"rules.yml:4: buildSortRegex has 3 groups", `rules.yml:4: the build number group 2 of buildSortRegex matches "a"`},
+		},
+		{
+			"repositories: [app]\nvalidTags:\n  - '.*'\nbuildSortRegex: (?P<flavor>[a-z]+)_(?P<distro>[a-z]+)_(?P<buildnr>[0-9]+)\n",
+			[]string{"rules.yml:4: buildSortRegex has the unknown group name distro"},
+		},
+		{
+			"repositories: [app]\nvalidTags:\n  - '.*'\n  - '[0-9'\nkeepBuilds: -1\nkeepbuilds: 2\n",
+			[]string{"rules.yml:4: validTags regexp \"[0-9\" isnt valid", "rules.yml:6: unknown key keepbuilds", "rules.yml:5: keepBuilds is negative (-1)"},
+		},
+		{
+			"validTags: []\n",
+			[]string{"rules.yml: atleast one repositories needes to be added", "rules.yml:1: atleast one tag regex needs to be added"},
+		},
+	}
+
+	for i, tt := range tests {
+		issues := lintRules("rules.yml", []byte(tt.rules))
+		assert.Equal(t, len(tt.issues), len(issues), "TestLintRules "+strconv.Itoa(i+1)+" values should be equal: "+strings.Join(issueStrings(issues), "; "))
+		for _, want := range tt.issues {
+			found := false
+			for _, issue := range issueStrings(issues) {
+				found = found || strings.HasPrefix(issue, want)
+			}
+			assert.True(t, found, "TestLintRules "+strconv.Itoa(i+1)+" should report "+want)
+		}
+	}
+}
+
+func issueStrings(issues []lintIssue) []string {
+	ret := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		ret = append(ret, issue.String())
+	}
+	return ret
+}
+
+func TestRegexOverlap(t *testing.T) {
+	var tests = []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"build_([0-9]+)", "^release_[0-9]+$", false},
+		{"build_([0-9]+)", "^build_[1-9][0-9]*$", true},
+		{"build_([0-9]+)$", "^build_[0-9]+-rc$", false},
+		{"^build_([0-9]+)", "^v[0-9]+-build_[0-9]+$", false},
+		{"([a-z]+[0-9])_build_([0-9]+)", "^centos[5-7]_build_[0-9]+$", true},
+		{"build([0-9]+)$", `^v[0-9]+\.[0-9]+\.[0-9]+-build[0-9]+$`, true},
+		{"build_([0-9]+)", "^[a-z]+$", false},
+		{"(?i)BUILD_([0-9]+)", "^build_[0-9]+$", true},
+		{"build_([0-9]+)", "release", true},
+	}
+
+	for i, tt := range tests {
+		overlap, ok := regexOverlap(tt.a, tt.b)
+		assert.True(t, ok)
+		assert.Equal(t, tt.overlap, overlap, "TestRegexOverlap "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestRegexSamples(t *testing.T) {
+	var tests = []struct {
+		expr    string
+		samples []string
+	}{
+		{"([A-Za-z]+)_build_([0-9]+)", []string{"A_build_0"}},
+		{"^release-v[0-9]{3}$", []string{"release-v000"}},
+		{"(dev|prod)_[0-9]*", []string{"dev_", "prod_"}},
+		{"a.b?", []string{"aa"}},
+	}
+
+	for i, tt := range tests {
+		re, err := syntax.Parse(tt.expr, syntax.Perl)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.samples, regexSamples(re.Simplify(), lintSamples), "TestRegexSamples "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
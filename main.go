@@ -7,11 +7,11 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -25,11 +25,32 @@ import (
 )
 
 type config struct {
-	Host              string `yaml:"host"`
-	User              string `yaml:"user"`
-	Password          string `yaml:"password"`
-	PoolSize          int    `yaml:"poolSize"`
-	ParallelDownloads int    `yaml:"parallelDownloads"`
+	Name                  string  `yaml:"name"`
+	Type                  string  `yaml:"type"`
+	Host                  string  `yaml:"host"`
+	User                  string  `yaml:"user"`
+	Password              string  `yaml:"password"`
+	PoolSize              int     `yaml:"poolSize"`
+	ParallelDownloads     int     `yaml:"parallelDownloads"`
+	RequestsPerSecond     float64 `yaml:"requestsPerSecond"`
+	MaxConcurrentRequests int     `yaml:"maxConcurrentRequests"`
+	MetricsListen         string  `yaml:"metricsListen"`
+	MetricsTextfile       string  `yaml:"metricsTextfile"`
+	BackupDir             string  `yaml:"backupDir"`
+	QuarantineFile        string  `yaml:"quarantineFile"`
+	CacheFile             string  `yaml:"cacheFile"`
+	CacheSize             int     `yaml:"cacheSize"`
+	StateFile             string  `yaml:"stateFile"`
+	Schedule              string  `yaml:"schedule"`
+	ScheduleJitter        int     `yaml:"scheduleJitter"`
+	ShutdownTimeout       int     `yaml:"shutdownTimeout"`
+	Insecure              bool    `yaml:"insecure"`
+	CAFile                string  `yaml:"caFile"`
+	CertFile              string  `yaml:"certFile"`
+	KeyFile               string  `yaml:"keyFile"`
+	DeleteMode            string  `yaml:"deleteMode"`
+
+	Registries []registryConfig `yaml:"registries"`
 }
 
 type rule struct {
@@ -42,6 +63,13 @@ type rule struct {
 	KeepNewestBySort   int `yaml:"keepBuilds"`
 
 	MinAge int `yaml:"minAgeBeforeDelete"`
+
+	QuarantineDays int `yaml:"quarantineDays"`
+
+	ArchiveDir       string   `yaml:"archiveDir"`
+	ArchiveFormat    string   `yaml:"archiveFormat"`
+	ArchiveTags      []string `yaml:"archiveTags"`
+	ArchiveTagsRegex []*regexp.Regexp
 }
 
 type tagFlavor struct {
@@ -63,128 +91,186 @@ func (t tagFlavors) Less(i, j int) bool {
 	return t[i].number > t[j].number
 }
 
-type layer struct {
-	Created time.Time `json:"created"`
-}
-
 var (
 	cfg       config
 	rules     rule
 	pool      chan bool
 	downloads chan bool
 
-	dryRun   *bool
-	insecure *bool
-	hub      *registry.Registry
+	dryRun       bool
+	insecure     bool
+	fullScan     bool
+	estimate     bool
+	registryScan bool
+	storagePath  string
+	hub          *registry.Registry
+	quarantined  *quarantine
+	metadata     = newMetadataCache(defaultCacheSize)
+	incremental  *incrementalState
+
+	// rulesHash identifies the rules in the incremental state
+	rulesHash string
+
+	// runDir is the backup directory of this run
+	runDir string
+	// plan collects the removed blobs of this run for the registry scan
+	plan *removalPlan
 )
 
-func init() {
-	dryRun = flag.Bool("dryRun", false, "dont remove images (default false)")
-	insecure = flag.Bool("insecure", false, "allowe insecure connection to the docker registry (default false)")
-	configFileName := flag.String("config", "config.yml", "the config file")
-	rulesFileName := flag.String("rules", "rules.yml", "the rule file")
-	flag.Parse()
-
-	configFile, err := ioutil.ReadFile(*configFileName)
+func readConfig(configFileName string) (config, error) {
+	c := config{}
+	configFile, err := ioutil.ReadFile(configFileName)
 	if err != nil {
-		log.Fatal("Config file is missing: config.yml\n", err)
+		return c, fmt.Errorf("config file %s is missing: %s", configFileName, err)
 	}
+	if err := yaml.Unmarshal(configFile, &c); err != nil {
+		return c, fmt.Errorf("config file %s is malformed: %s", configFileName, err)
+	}
+	return c, nil
+}
 
-	err = yaml.Unmarshal(configFile, &cfg)
+// loadConfig reads the config and the rules of every registry in it. The
+// flags of the command have to be parsed before, they are checked against the
+// registry types.
+func loadConfig(configFileName, rulesFileName string) error {
+	var err error
+	cfg, err = readConfig(configFileName)
 	if err != nil {
-		log.Fatal("credentials file is malformed\n", err)
+		return err
 	}
 
-	rulesFile, err := ioutil.ReadFile(*rulesFileName)
+	configs, rulesFiles, err := registryTargets(cfg, rulesFileName)
 	if err != nil {
-		log.Fatal("Config file is missing: rules.yml\n", err)
+		return fmt.Errorf("config file %s is malformed: %s", configFileName, err)
 	}
-
-	if err := yaml.Unmarshal(rulesFile, &rules); err != nil {
-		log.Fatal("rules file is malformed\n", err)
+	targets = nil
+	for i := range configs {
+		t, err := loadTarget(configs[i], rulesFiles[i])
+		if err != nil {
+			return err
+		}
+		targets = append(targets, t)
 	}
 
-	sort.Strings(rules.Repositories)
-
-	verifyRules()
+	if cfg.CacheFile != "" {
+		metadata, err = loadMetadataCache(cfg.CacheFile, cfg.CacheSize)
+		if err != nil {
+			return fmt.Errorf("cache file is malformed: %s", err)
+		}
+	}
 
-	pool = make(chan bool, cfg.PoolSize)
-	downloads = make(chan bool, cfg.ParallelDownloads)
+	use(targets[0])
+	return nil
 }
 
-func verifyRules() {
+func verifyRules(rules *rule) error {
 	if len(rules.Repositories) == 0 {
-		log.Fatalf("atleast one repositories needes to be added")
+		return fmt.Errorf("atleast one repositories needes to be added")
 	}
 
 	if len(rules.ValidTags) != 0 {
 		for _, repo := range rules.ValidTags {
 			regex, err := regexp.Compile(repo)
 			if err != nil {
-				log.Fatalf("some tag regexp isnt valid (%s)", err)
+				return fmt.Errorf("some tag regexp isnt valid (%s)", err)
 			}
 			rules.ValidTagsRegex = append(rules.ValidTagsRegex, regex)
 		}
 	} else {
-		log.Fatalf("atleast one tag regex needs to be added")
+		return fmt.Errorf("atleast one tag regex needs to be added")
 	}
 
 	regex, err := regexp.Compile(rules.SortAndFilter)
 	if err != nil {
-		log.Fatalf("sort release regex isnt valid (%s)", err)
+		return fmt.Errorf("sort release regex isnt valid (%s)", err)
 	}
 	rules.SortAndFilterRegex = regex
-}
 
-func removeImage(repo string, digest digest.Digest) {
-	err := hub.DeleteManifest(repo, digest)
-	if err != nil {
-		fmt.Println("ERROR: ", err)
+	switch rules.ArchiveFormat {
+	case "":
+		rules.ArchiveFormat = archiveOCI
+	case archiveOCI, archiveDocker:
+	default:
+		return fmt.Errorf("archive format %s is unknown, use %s or %s", rules.ArchiveFormat, archiveOCI, archiveDocker)
 	}
-}
-
-// filterOlderTagsn returns all tags that are older then age
-func oldTags(age int, repo string) func(string) bool {
-	return func(tag string) bool {
-		if age < 0 {
-			return false
+	for _, tag := range rules.ArchiveTags {
+		regex, err := regexp.Compile(tag)
+		if err != nil {
+			return fmt.Errorf("some archive tag regexp isnt valid (%s)", err)
 		}
+		rules.ArchiveTagsRegex = append(rules.ArchiveTagsRegex, regex)
+	}
+	return nil
+}
 
-		if age == 0 {
-			return true
+// checkType verifies the registry type against the flags
+func checkType(c *config) error {
+	switch c.Type {
+	case "":
+		c.Type = typeRegistry
+	case typeRegistry:
+	case typeHarbor:
+		if storagePath != "" || estimate || registryScan {
+			return fmt.Errorf("-storage, -estimate and -registryScan are not supported for harbor")
 		}
-
-		downloads <- true
-		defer func() { <-downloads }()
-
-		mani, err := hub.Manifest(repo, tag)
-		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+	case typeGitlab:
+		if storagePath != "" || estimate || registryScan || c.BackupDir != "" {
+			return fmt.Errorf("-storage, -estimate, -registryScan and backupDir are not supported for gitlab")
 		}
+	default:
+		return fmt.Errorf("unknown registry type %q", c.Type)
+	}
+	return nil
+}
 
-		reader, err := hub.DownloadLayer(repo, mani.References()[0].Digest)
-		defer reader.Close()
-		if err != nil {
-			log.Fatalf("ERROR: %s", err)
-		}
+// checkStorage rejects -storage for a run over several registries, it is the
+// storage of a single registry and would get the rules of all of them
+func checkStorage() error {
+	if storagePath != "" && len(targets) > 1 {
+		return fmt.Errorf("-storage is the storage of a single registry, but %d registries are configured", len(targets))
+	}
+	return nil
+}
 
-		b, err := ioutil.ReadAll(reader)
+func removeImage(ctx context.Context, b backend, repo string, digest digest.Digest) error {
+	var size int64
+	if cfg.MetricsListen != "" || cfg.MetricsTextfile != "" {
+		var err error
+		size, err = manifestSize(ctx, b, repo, digest)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			fmt.Println("ERROR: ", err)
 		}
+	}
 
-		l := layer{}
-		err = json.Unmarshal(b, &l)
-		if err != nil {
-			log.Fatalf("ERROR: %s", err)
-		}
+	err := b.DeleteDigest(ctx, repo, digest)
+	if err != nil {
+		metricDeletions.add(1, registryLabel(), repo, "error")
+		return err
+	}
+	metricDeletions.add(1, registryLabel(), repo, "success")
+	metricReclaimedBytes.add(float64(size), registryLabel(), repo)
+	return nil
+}
 
-		if time.Now().Sub(l.Created) >= time.Duration(age)*24*time.Hour {
-			return true
-		}
+// removeTag removes a single tag, the manifest stays if other tags use it
+func removeTag(ctx context.Context, b backend, repo, tag string, dgst digest.Digest) error {
+	if err := b.DeleteTag(ctx, repo, tag, dgst); err != nil {
+		metricDeletions.add(1, registryLabel(), repo, "error")
+		return err
+	}
+	metricDeletions.add(1, registryLabel(), repo, "success")
+	return nil
+}
 
-		return false
+// olderThan checks if created is at least age days before now, otherwise
+// recheck is set to the time it gets old enough
+func olderThan(age int, created, now time.Time, recheck *recheckTime) bool {
+	if now.Sub(created) >= time.Duration(age)*24*time.Hour {
+		return true
 	}
+
+	recheck.update(created.Add(time.Duration(age) * 24 * time.Hour))
+	return false
 }
 
 func getFlavor(keepRegex *regexp.Regexp, tags []string) map[string]tagFlavors {
@@ -253,50 +339,16 @@ func getExpiredBuildTags(number int, keepRegex *regexp.Regexp, tags tagFlavors)
 	return ret
 }
 
-func getDigestForTags(repo string, tags []string) []string {
+func getDigestForTags(ctx context.Context, b backend, repo string, tags []string) ([]string, error) {
 	digestMap := make([]string, 0)
 	for _, tag := range tags {
-		digest, err := hub.ManifestDigest(repo, tag)
+		digest, err := b.Digest(ctx, repo, tag)
 		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+			return nil, fmt.Errorf("digest of %s: %s", tag, err)
 		}
 		digestMap = append(digestMap, digest.String())
 	}
-	return digestMap
-}
-
-func getSaveTagsToRemove(repo string, candidatesToRemove, digestToSave []string) ([]string, []digest.Digest) {
-	tagsToRemove := make([]string, 0)
-	digestToRemove := make([]digest.Digest, 0)
-
-	if !sort.StringsAreSorted(digestToSave) {
-		sort.Strings(digestToSave)
-	}
-
-	var wg sync.WaitGroup
-	var mutex = &sync.Mutex{}
-
-	for _, tag := range candidatesToRemove {
-		wg.Add(1)
-		downloads <- true
-		go func(repo, tag string) {
-			digest, err := hub.ManifestDigest(repo, tag)
-			<-downloads
-			if err != nil {
-				log.Fatalf("ERROR: %s", err)
-			}
-			if !contains(digestToSave, digest.String()) {
-				mutex.Lock()
-				tagsToRemove = append(tagsToRemove, tag)
-				digestToRemove = append(digestToRemove, digest)
-				mutex.Unlock()
-			}
-			wg.Done()
-		}(repo, tag)
-	}
-	wg.Wait()
-
-	return tagsToRemove, digestToRemove
+	return digestMap, nil
 }
 
 func getInvalidTags(valid []*regexp.Regexp, tags []string) []string {
@@ -318,58 +370,340 @@ func validTag(valid []*regexp.Regexp, tag string) bool {
 	return false
 }
 
-func main() {
+// run cleans up every registry of the config one after another. A failing
+// registry does not stop the others, it is part of the combined summary.
+func run(ctx, stopping context.Context) (*runSummary, error) {
+	started := time.Now()
+	var summary *runSummary
 	var err error
 
-	if !*insecure {
-		hub, err = registry.New(cfg.Host, cfg.User, cfg.Password, registry.Quiet)
+	if len(targets) == 1 {
+		use(targets[0])
+		summary, err = runRegistry(ctx, stopping)
 	} else {
-		hub, err = registry.NewInsecure(cfg.Host, cfg.User, cfg.Password, registry.Quiet)
+		summary = &runSummary{}
+		for _, t := range targets {
+			if stopping.Err() != nil {
+				summary.Interrupted = true
+				break
+			}
+			use(t)
+			s, err := runRegistry(ctx, stopping)
+			if err != nil {
+				fmt.Println("ERROR: ", t.name, err)
+			}
+			fmt.Println("Summary", t.name+": ", s)
+			summary.merge(t.name, s, err)
+		}
+	}
+
+	if cfg.CacheFile != "" {
+		if cacheErr := metadata.save(cfg.CacheFile); cacheErr != nil && err == nil {
+			err = cacheErr
+		}
 	}
 
+	summary.Duration = time.Since(started)
+	metricRunDuration.set(summary.Duration.Seconds())
+	metricLastRun.set(float64(time.Now().Unix()))
+	return summary, err
+}
+
+// runRegistry cleans up the repositories of the registry in cfg
+func runRegistry(ctx, stopping context.Context) (*runSummary, error) {
+	started := time.Now()
+	summary := &runSummary{}
+
+	b, err := newBackend(ctx, true)
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		return summary, err
+	}
+	summary.DeleteMode = deleteMode(b)
+	fmt.Println("Delete mode: ", summary.DeleteMode)
+
+	runDir = ""
+	if cfg.BackupDir != "" {
+		runDir = filepath.Join(cfg.BackupDir, started.UTC().Format("20060102T150405Z"))
+	}
+
+	plan = nil
+	if registryScan {
+		plan = newRemovalPlan()
 	}
 
 	var wg sync.WaitGroup
 
+repos:
 	for _, repo := range rules.Repositories {
-		pool <- true
+		select {
+		case pool <- true:
+		case <-stopping.Done():
+			break repos
+		}
+		if stopping.Err() != nil {
+			// the slot was taken while the shutdown started
+			<-pool
+			break
+		}
 		wg.Add(1)
-		go work(repo, &wg, pool)
+		go work(ctx, stopping, b, repo, &wg, pool, summary)
 	}
 
 	wg.Wait()
+	summary.Interrupted = stopping.Err() != nil
+
+	if plan != nil && !summary.Interrupted {
+		report, err := analyzeSharing(ctx, b, plan, 10)
+		if err != nil {
+			fmt.Println("ERROR: registry scan failed: ", err)
+		} else {
+			printSharingReport(report)
+		}
+	}
+
+	if quarantined != nil && !dryRun {
+		if err := quarantined.save(cfg.QuarantineFile); err != nil {
+			return summary, err
+		}
+	}
+
+	if incremental != nil && !dryRun {
+		if err := incremental.save(cfg.StateFile); err != nil {
+			return summary, err
+		}
+	}
+
+	summary.Duration = time.Since(started)
+	return summary, nil
+}
+
+func main() {
+	os.Exit(runCommand(os.Args[1:]))
 }
 
-func work(repo string, wg *sync.WaitGroup, pool chan bool) {
+func work(ctx, stopping context.Context, b backend, repo string, wg *sync.WaitGroup, pool chan bool, summary *runSummary) {
 	defer wg.Done()
 	defer func() { <-pool }()
 
-	tags, err := hub.Tags(repo)
-	if err != nil || len(tags) == 0 {
-		fmt.Println(err)
+	started := time.Now()
+	defer func() { metricRepositoryDuration.set(time.Since(started).Seconds(), registryLabel(), repo) }()
+
+	removed, held, err := cleanRepository(ctx, stopping, b, repo, summary)
+	if err == errUnchanged {
+		fmt.Println(repo, "Skipped: ", err)
+		summary.skip()
 		return
 	}
+	if err != nil {
+		fmt.Println("ERROR: ", repo, err)
+	}
+	summary.add(repo, removed, held, err)
+}
+
+// cleanRepository removes the tags of repo that are not kept by the rules. It
+// returns the number of removed and quarantined tags. All registry lookups
+// happen before anything is removed, so a lookup error leaves the repository
+// untouched. Once stopping is done no further digest is removed. If the
+// backend removes single tags a tag is removed even if another tag of its
+// digest is kept.
+func cleanRepository(ctx, stopping context.Context, b backend, repo string, summary *runSummary) (int, int, error) {
+	infos, err := b.Tags(ctx, repo)
+	if err != nil {
+		return 0, 0, err
+	}
+	tags := tagNames(infos)
+	if len(tags) == 0 {
+		return 0, 0, nil
+	}
+
+	metricTagsScanned.add(float64(len(tags)), registryLabel(), repo)
+	if incremental != nil && !fullScan && incremental.unchanged(repo, fingerprint(tags, rulesHash), time.Now()) {
+		return 0, 0, errUnchanged
+	}
 
-	invalidTags := getInvalidTags(rules.ValidTagsRegex, tags)
+	tagDelete := b.Capabilities().TagDelete
+	b = newListedTags(b, infos)
 
-	flavorTags := getFlavor(rules.SortAndFilterRegex, tags)
-	expiredBuildTags := make([]string, 0)
-	for _, ftags := range flavorTags {
-		expiredBuildTags = append(expiredBuildTags, getExpiredBuildTags(rules.KeepNewestBySort, rules.SortAndFilterRegex, ftags)...)
+	// signatures, attestations and SBOMs are not judged by the rules, they
+	// follow their subject
+	ruleTags, artifacts := splitSubjectTags(tags)
+
+	recheck := &recheckTime{}
+	decisions, digests, err := decideTags(ctx, b, repo, ruleTags, tagDelete, time.Now(), recheck)
+	if err != nil {
+		return 0, 0, err
+	}
+	tagsSaveToRemove := make([]string, 0)
+	digestSaveToRemove := make([]digest.Digest, 0)
+	digestToSave := make([]string, 0)
+	for _, d := range decisions {
+		if d.Remove {
+			tagsSaveToRemove = append(tagsSaveToRemove, d.Tag)
+			digestSaveToRemove = append(digestSaveToRemove, digests[d.Tag])
+		} else {
+			digestToSave = append(digestToSave, digests[d.Tag].String())
+		}
+	}
+	metricCandidates.add(float64(len(tagsSaveToRemove)), registryLabel(), repo)
+
+	candidateDigests := digestSaveToRemove
+
+	var held []string
+	if quarantined != nil {
+		tagsSaveToRemove, digestSaveToRemove, held = quarantined.update(repo, tagsSaveToRemove, digestSaveToRemove, time.Now())
+		fmt.Println(repo, "Tags in quarantine: ", held)
+		if due := quarantined.nextDue(repo); !due.IsZero() {
+			recheck.update(due)
+		}
 	}
-	removeCandidate := append(invalidTags, expiredBuildTags...)
 
-	tagsToRemove := parallelFilter(removeCandidate, oldTags(rules.MinAge, repo))
-	digestToSave := getDigestForTags(repo, notIn(tags, tagsToRemove))
+	// manifests that keep a tag are not removed
+	revisionsToRemove := notInDigests(digestSaveToRemove, digestToSave)
 
-	tagsSaveToRemove, digestSaveToRemove := getSaveTagsToRemove(repo, tagsToRemove, digestToSave)
+	artifactTags := subjectArtifacts(artifacts, revisionsToRemove)
+	artifactDigests, err := getDigestForTags(ctx, b, repo, artifactTags)
+	if err != nil {
+		return 0, len(held), err
+	}
+	for i, tag := range artifactTags {
+		tagsSaveToRemove = append(tagsSaveToRemove, tag)
+		digestSaveToRemove = append(digestSaveToRemove, digest.Digest(artifactDigests[i]))
+		revisionsToRemove = append(revisionsToRemove, digest.Digest(artifactDigests[i]))
+	}
+	referrers, err := subjectReferrers(ctx, b, repo, revisionsToRemove)
+	if err != nil {
+		return 0, len(held), fmt.Errorf("referrers: %s", err)
+	}
+	revisionsToRemove = append(revisionsToRemove, referrers...)
 
 	fmt.Println(repo, "Tags that will be removed: ", tagsSaveToRemove)
-	if !*dryRun {
-		for i := range digestSaveToRemove {
-			removeImage(repo, digestSaveToRemove[i])
+	if len(referrers) != 0 {
+		fmt.Println(repo, "Referrers that will be removed: ", referrers)
+	}
+
+	if plan != nil {
+		removedDigests, _ := splitDigests(nil, nil, revisionsToRemove)
+		if err := plan.add(ctx, b, repo, removedDigests); err != nil {
+			return 0, len(held), fmt.Errorf("registry scan failed: %s", err)
+		}
+	}
+
+	if estimate {
+		removedDigests, keptDigests := splitDigests(digestToSave, candidateDigests, revisionsToRemove)
+		size, err := reclaimableSize(ctx, b, repo, removedDigests, keptDigests)
+		if err != nil {
+			return 0, len(held), fmt.Errorf("estimation failed: %s", err)
+		}
+		// removing the last tag of a manifest only untags it, the blobs are
+		// only freed by a garbage-collection with --delete-untagged
+		if tagDelete {
+			fmt.Println(repo, "Reclaimable space after removing untagged manifests: ", formatBytes(size))
+			summary.addUntagged(size)
+		} else {
+			fmt.Println(repo, "Reclaimable space: ", formatBytes(size))
+			summary.addReclaimable(size)
 		}
 	}
+
+	if dryRun {
+		return len(tagsSaveToRemove), len(held), nil
+	}
+
+	if stopping.Err() != nil {
+		return 0, len(held), errInterrupted
+	}
+
+	tagsByDigest := groupTagsByDigest(tagsSaveToRemove, digestSaveToRemove)
+	if runDir != "" {
+		for dgst, tags := range tagsByDigest {
+			if err := backupManifest(ctx, b, runDir, repo, dgst, tags); err != nil {
+				return 0, len(held), fmt.Errorf("backup of %s failed: %s", dgst, err)
+			}
+		}
+		for _, dgst := range referrers {
+			if _, tagged := tagsByDigest[dgst]; tagged {
+				continue
+			}
+			if err := backupManifest(ctx, b, runDir, repo, dgst, nil); err != nil {
+				return 0, len(held), fmt.Errorf("backup of referrer %s failed: %s", dgst, err)
+			}
+		}
+	}
+
+	// nothing is removed unless every selected image is archived
+	for dgst, tags := range tagsByDigest {
+		if !archiveSelected(tags) {
+			continue
+		}
+		path, size, err := archiveImage(ctx, b, repo, dgst, tags)
+		if err != nil {
+			return 0, len(held), fmt.Errorf("archive of %s failed: %s", dgst, err)
+		}
+		fmt.Println(repo, "Archived: ", dgst, tags, path, formatBytes(size))
+		summary.addArchived(size)
+	}
+
+	var removed int
+	if tagDelete {
+		removed, err = removeTags(ctx, stopping, b, repo, tagsSaveToRemove, digestSaveToRemove)
+	} else {
+		removed, err = removeDigests(ctx, stopping, b, repo, tagsByDigest)
+	}
+	if err != nil {
+		return removed, len(held), err
+	}
+
+	// referrers are removed after their subject, so a failure leaves an
+	// orphan instead of an image without its signature
+	for _, dgst := range referrers {
+		if err := removeImage(ctx, b, repo, dgst); err != nil {
+			fmt.Println("ERROR: ", repo, err)
+			return removed, len(held), fmt.Errorf("referrer %s could not be removed: %s", dgst, err)
+		}
+	}
+
+	if incremental != nil {
+		incremental.record(repo, notIn(tags, tagsSaveToRemove), tagsSaveToRemove, recheck.get(), time.Now())
+	}
+	return removed, len(held), nil
+}
+
+// removeDigests removes whole manifests with all of their tags
+func removeDigests(ctx, stopping context.Context, b backend, repo string, tagsByDigest map[digest.Digest][]string) (int, error) {
+	removed, failed := 0, 0
+	for dgst, tags := range tagsByDigest {
+		if stopping.Err() != nil {
+			return removed, fmt.Errorf("%w after removing %d tags", errInterrupted, removed)
+		}
+		if err := removeImage(ctx, b, repo, dgst); err != nil {
+			fmt.Println("ERROR: ", repo, err)
+			failed++
+			continue
+		}
+		removed += len(tags)
+	}
+	if failed != 0 {
+		return removed, fmt.Errorf("%d of %d digests could not be removed", failed, len(tagsByDigest))
+	}
+	return removed, nil
+}
+
+// removeTags removes the tags one by one instead of whole manifests
+func removeTags(ctx, stopping context.Context, b backend, repo string, tagsToRemove []string, digests []digest.Digest) (int, error) {
+	removed, failed := 0, 0
+	for i, tag := range tagsToRemove {
+		if stopping.Err() != nil {
+			return removed, fmt.Errorf("%w after removing %d tags", errInterrupted, removed)
+		}
+		if err := removeTag(ctx, b, repo, tag, digests[i]); err != nil {
+			fmt.Println("ERROR: ", repo, tag, err)
+			failed++
+			continue
+		}
+		removed++
+	}
+	if failed != 0 {
+		return removed, fmt.Errorf("%d of %d tags could not be removed", failed, len(tagsToRemove))
+	}
+	return removed, nil
 }
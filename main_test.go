@@ -7,13 +7,26 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"os"
 	"regexp"
 	"strconv"
 	"testing"
 
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 )
 
+// TestMain points the globals at a registry like the config.yml of the
+// repository, the commands load it otherwise
+func TestMain(m *testing.M) {
+	targets = []*target{{name: "default", cfg: config{Type: typeRegistry, PoolSize: 3, ParallelDownloads: 10}}}
+	use(targets[0])
+	os.Exit(m.Run())
+}
+
 func TestGetFlavor(t *testing.T) {
 	var tests = []struct {
 		inRegex *regexp.Regexp
@@ -214,7 +227,7 @@ func TestLen(t *testing.T) {
 	for _, tt := range tests {
 		b := tt.tf.Len()
 		if b != tt.out {
-			t.Errorf("%q.Len() => %q, want %q", tt.tf, b, tt.out)
+			t.Errorf("%v.Len() => %d, want %d", tt.tf, b, tt.out)
 		}
 	}
 }
@@ -241,3 +254,158 @@ func TestSwap(t *testing.T) {
 		assert.Equal(t, tt.tfout, tt.tf, "TestSwap "+strconv.Itoa(i+1)+" they should be equal")
 	}
 }
+
+func TestCleanRepository(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	oldRules := rules
+	defer func() { rules = oldRules }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+	}
+
+	manifest := func(i int) []byte {
+		return []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `","config":{"digest":"sha256:0` + strconv.Itoa(i) + `"}}`)
+	}
+	for i := 1; i <= 3; i++ {
+		f.addManifest("app", schema2.MediaTypeManifest, manifest(i), "build_"+strconv.Itoa(i))
+	}
+	f.addManifest("app", schema2.MediaTypeManifest, manifest(4), "release_1")
+
+	removed, held, err := cleanRepository(context.Background(), context.Background(), &registryBackend{}, "app", &runSummary{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, 0, held)
+	assert.Equal(t, []string{"build_3", "release_1"}, f.tagsOf("app"))
+
+	// a missing manifest fails the repository before anything is removed
+	for i := 1; i <= 3; i++ {
+		f.addManifest("broken", schema2.MediaTypeManifest, manifest(i), "build_"+strconv.Itoa(i))
+	}
+	delete(f.repo("broken").manifests, digest.FromBytes(manifest(3)))
+
+	removed, _, err = cleanRepository(context.Background(), context.Background(), &registryBackend{}, "broken", &runSummary{})
+	assert.Error(t, err)
+	assert.Equal(t, 0, removed)
+	assert.Equal(t, []string{"build_1", "build_2", "build_3"}, f.tagsOf("broken"))
+
+	// nothing is removed once the shutdown started
+	for i := 1; i <= 3; i++ {
+		f.addManifest("stopped", schema2.MediaTypeManifest, manifest(i), "build_"+strconv.Itoa(i))
+	}
+	stopping, stop := context.WithCancel(context.Background())
+	stop()
+
+	removed, _, err = cleanRepository(context.Background(), stopping, &registryBackend{}, "stopped", &runSummary{})
+	assert.Equal(t, errInterrupted, err)
+	assert.Equal(t, 0, removed)
+	assert.Equal(t, []string{"build_1", "build_2", "build_3"}, f.tagsOf("stopped"))
+}
+
+func TestProbeTagDeletion(t *testing.T) {
+	for i, supported := range []bool{false, true} {
+		f := newFakeRegistry()
+		f.tagDeletion = supported
+		srv := startFakeRegistry(f)
+
+		ok, err := probeTagDeletion(context.Background(), "app")
+		assert.NoError(t, err)
+		assert.Equal(t, supported, ok, "TestProbeTagDeletion "+strconv.Itoa(i+1)+" values should be equal")
+		srv.Close()
+	}
+
+	var tests = []struct {
+		status    int
+		body      string
+		tagDelete bool
+		err       bool
+	}{
+		{http.StatusAccepted, "", true, false},
+		{http.StatusNotFound, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, true, false},
+		{http.StatusNotFound, `{"errors":[{"code":"NAME_UNKNOWN"}]}`, false, true},
+		{http.StatusNotFound, "", false, true},
+		{http.StatusBadRequest, `{"errors":[{"code":"DIGEST_INVALID"}]}`, false, false},
+		{http.StatusMethodNotAllowed, `{"errors":[{"code":"UNSUPPORTED"}]}`, false, false},
+		{http.StatusUnauthorized, `{"errors":[{"code":"UNAUTHORIZED"}]}`, false, true},
+		{http.StatusForbidden, "", false, true},
+		{http.StatusInternalServerError, "", false, true},
+		{http.StatusOK, "", false, true},
+	}
+	for i, tt := range tests {
+		srv := startFakeRegistry(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+
+		ok, err := probeTagDeletion(context.Background(), "app")
+		assert.Equal(t, tt.err, err != nil, "TestProbeTagDeletion "+strconv.Itoa(i+1)+" error should be equal")
+		assert.Equal(t, tt.tagDelete, ok, "TestProbeTagDeletion "+strconv.Itoa(i+1)+" values should be equal")
+		srv.Close()
+	}
+}
+
+func TestTagDeletionMode(t *testing.T) {
+	oldCfg, oldRules := cfg, rules
+	defer func() { cfg, rules = oldCfg, oldRules }()
+	rules = rule{Repositories: []string{"app"}}
+
+	probes := 0
+	srv := startFakeRegistry(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		probes++
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	var tests = []struct {
+		mode      string
+		probe     bool
+		tagDelete bool
+		probes    int
+	}{
+		{deleteModeDigest, true, false, 0},
+		{deleteModeTag, true, true, 0},
+		{"", true, true, 1},
+		// the read-only commands
+		{deleteModeTag, false, true, 1},
+		{"", false, false, 1},
+	}
+	for i, tt := range tests {
+		cfg.DeleteMode = tt.mode
+		tagDelete, err := tagDeletion(context.Background(), tt.probe)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.tagDelete, tagDelete, "TestTagDeletionMode "+strconv.Itoa(i+1)+" values should be equal")
+		assert.Equal(t, tt.probes, probes, "TestTagDeletionMode "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestCleanRepositoryTagDeletion(t *testing.T) {
+	f := newFakeRegistry()
+	f.tagDeletion = true
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	oldRules := rules
+	defer func() { rules = oldRules }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+	}
+
+	manifest := func(i int) []byte {
+		return []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `","config":{"digest":"sha256:0` + strconv.Itoa(i) + `"}}`)
+	}
+	f.addManifest("app", schema2.MediaTypeManifest, manifest(1), "build_1", "release_1")
+	f.addManifest("app", schema2.MediaTypeManifest, manifest(2), "build_2")
+
+	// build_1 is removed by tag, release_1 on the same digest stays
+	removed, _, err := cleanRepository(context.Background(), context.Background(), &registryBackend{tagDelete: true}, "app", &runSummary{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, []string{"build_2", "release_1"}, f.tagsOf("app"))
+	assert.Contains(t, f.requests, "DELETE /v2/app/manifests/build_1")
+}
@@ -0,0 +1,268 @@
+// docker-unregstriy-untagger :- manifest helpers
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/wind0r/docker-registry-client/registry"
+)
+
+const (
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+)
+
+// manifestMediaTypes are all manifest types the untagger understands
+var manifestMediaTypes = []string{
+	schema2.MediaTypeManifest,
+	mediaTypeManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+	schema1.MediaTypeSignedManifest,
+}
+
+type descriptor struct {
+	MediaType string        `json:"mediaType"`
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+}
+
+// imageManifest covers the fields of schema1, schema2, OCI manifests and
+// indexes that are needed to follow references
+type imageManifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+	FSLayers  []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+}
+
+func parseManifest(mediaType string, payload []byte) (imageManifest, error) {
+	m := imageManifest{}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return m, err
+	}
+	if m.MediaType == "" {
+		m.MediaType = mediaType
+	}
+	return m, nil
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == mediaTypeManifestList || mediaType == mediaTypeOCIIndex
+}
+
+// blobs returns the config and layer descriptors a manifest references
+func (m imageManifest) blobs() []descriptor {
+	ret := make([]descriptor, 0)
+	if m.Config != nil {
+		ret = append(ret, *m.Config)
+	}
+	ret = append(ret, m.Layers...)
+	for _, l := range m.FSLayers {
+		ret = append(ret, descriptor{Digest: l.BlobSum})
+	}
+	return ret
+}
+
+// manifestSize returns the size of all blobs a manifest references
+func manifestSize(ctx context.Context, b backend, repo string, dgst digest.Digest) (int64, error) {
+	payload, mediaType, err := b.Manifest(ctx, repo, dgst)
+	if err != nil {
+		return 0, err
+	}
+	m, err := parseManifest(mediaType, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(0)
+	for _, blob := range m.blobs() {
+		size += blob.Size
+	}
+	return size, nil
+}
+
+// getManifest fetches the raw manifest with its content type, the vendored
+// client only knows about schema2
+func getManifest(ctx context.Context, repo, reference string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", hub.URL+"/v2/"+repo+"/manifests/"+reference, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+	resp, err := hub.Client.Do(req.WithContext(ctx))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// putManifest uploads a manifest of any supported type, PutManifest of the
+// vendored client only handles schema1
+func putManifest(ctx context.Context, repo, reference, mediaType string, payload []byte) error {
+	req, err := http.NewRequest("PUT", hub.URL+"/v2/"+repo+"/manifests/"+reference, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := hub.Client.Do(req.WithContext(ctx))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
+
+// deleteTag removes a single tag, the registry has to support deleting by tag
+func deleteTag(ctx context.Context, repo, tag string) error {
+	req, err := http.NewRequest("DELETE", hub.URL+"/v2/"+repo+"/manifests/"+tag, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := hub.Client.Do(req.WithContext(ctx))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
+
+// probeTagDeletion checks if the registry removes manifests by tag, like the
+// OCI distribution spec allows. A tag that does not exist is deleted: a
+// registry that supports it accepts the request or answers MANIFEST_UNKNOWN,
+// older registries reject the reference because it is no digest. Every other
+// answer, e.g. NAME_UNKNOWN for a missing repository or missing permissions,
+// is an error, deleteMode in config.yml skips the probe.
+func probeTagDeletion(ctx context.Context, repo string) (bool, error) {
+	tag := "untagger-probe-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	req, err := http.NewRequest("DELETE", hub.URL+"/v2/"+repo+"/manifests/"+tag, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := hub.Client.Do(req.WithContext(ctx))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusAccepted {
+			return true, nil
+		}
+		return false, fmt.Errorf("deleting a tag returned status %d, set deleteMode in config.yml", resp.StatusCode)
+	}
+
+	httpErr := statusError(err)
+	if httpErr == nil {
+		return false, err
+	}
+	status, codes := httpErr.Response.StatusCode, errorCodes(httpErr.Body)
+	switch {
+	case status == http.StatusNotFound && codes["MANIFEST_UNKNOWN"]:
+		return true, nil
+	case status == http.StatusBadRequest || status == http.StatusMethodNotAllowed || codes["UNSUPPORTED"]:
+		return false, nil
+	}
+	return false, fmt.Errorf("cannot tell if the registry deletes by tag, set deleteMode in config.yml: %s", err)
+}
+
+// errorCodes returns the codes of an error response of the registry API
+func errorCodes(body []byte) map[string]bool {
+	var resp struct {
+		Errors []struct {
+			Code string `json:"code"`
+		} `json:"errors"`
+	}
+	codes := make(map[string]bool)
+	if json.Unmarshal(body, &resp) != nil {
+		return codes
+	}
+	for _, e := range resp.Errors {
+		codes[e.Code] = true
+	}
+	return codes
+}
+
+// manifestDigest resolves a tag with a HEAD request that accepts every
+// supported manifest type. ManifestDigest of the vendored client only accepts
+// schema2, registries answer 404 for OCI manifests like cosign signatures.
+func manifestDigest(ctx context.Context, repo, reference string) (digest.Digest, error) {
+	req, err := http.NewRequest("HEAD", hub.URL+"/v2/"+repo+"/manifests/"+reference, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+	resp, err := hub.Client.Do(req.WithContext(ctx))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	return digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+}
+
+// hasManifest checks if a manifest exists without downloading it
+func hasManifest(ctx context.Context, repo string, dgst digest.Digest) (bool, error) {
+	req, err := http.NewRequest("HEAD", hub.URL+"/v2/"+repo+"/manifests/"+dgst.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+	resp, err := hub.Client.Do(req.WithContext(ctx))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// statusError returns the response of the registry if err is an error status
+func statusError(err error) *registry.HttpStatusError {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return nil
+	}
+	httpErr, _ := urlErr.Err.(*registry.HttpStatusError)
+	return httpErr
+}
+
+// isNotFound returns true if err is a 404 returned by the registry
+func isNotFound(err error) bool {
+	httpErr := statusError(err)
+	return httpErr != nil && httpErr.Response.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,209 @@
+// docker-unregstriy-untagger :- image metadata cache
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const defaultCacheSize = 100000
+
+// imageConfig are the fields of an image config blob the untagger needs
+type imageConfig struct {
+	Created time.Time `json:"created"`
+	Config  struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// imageMetadata describes a manifest, it never changes for a digest
+type imageMetadata struct {
+	Created   time.Time         `json:"created"`
+	Size      int64             `json:"size"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	MediaType string            `json:"mediaType"`
+	LastUsed  time.Time         `json:"lastUsed"`
+}
+
+// metadataCache maps digests to their metadata, the least recently used
+// entries are dropped when it grows over max
+type metadataCache struct {
+	sync.Mutex
+	Entries map[digest.Digest]*imageMetadata `json:"entries"`
+
+	max int
+}
+
+func newMetadataCache(max int) *metadataCache {
+	if max <= 0 {
+		max = defaultCacheSize
+	}
+	return &metadataCache{Entries: make(map[digest.Digest]*imageMetadata), max: max}
+}
+
+// loadMetadataCache reads the cache file, a missing file is an empty cache
+func loadMetadataCache(fileName string, max int) (*metadataCache, error) {
+	c := newMetadataCache(max)
+
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if c.Entries == nil {
+		c.Entries = make(map[digest.Digest]*imageMetadata)
+	}
+	// the file may be from a run with a larger cacheSize
+	c.trim()
+	return c, nil
+}
+
+func (c *metadataCache) get(d digest.Digest) (imageMetadata, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	m, ok := c.Entries[d]
+	if !ok {
+		return imageMetadata{}, false
+	}
+	m.LastUsed = time.Now().UTC()
+	return *m, true
+}
+
+func (c *metadataCache) put(d digest.Digest, m imageMetadata) {
+	c.Lock()
+	defer c.Unlock()
+
+	m.LastUsed = time.Now().UTC()
+	c.Entries[d] = &m
+	c.trim()
+}
+
+// trim drops the least recently used entries once the cache grows over max.
+// It drops a tenth of max more than needed, so the entries are not sorted
+// again for every new digest. The caller holds the lock.
+func (c *metadataCache) trim() {
+	if len(c.Entries) <= c.max {
+		return
+	}
+	keep := c.max - c.max/10
+
+	digests := make([]digest.Digest, 0, len(c.Entries))
+	for d := range c.Entries {
+		digests = append(digests, d)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return c.Entries[digests[i]].LastUsed.Before(c.Entries[digests[j]].LastUsed)
+	})
+	for _, d := range digests[:len(digests)-keep] {
+		delete(c.Entries, d)
+	}
+}
+
+func (c *metadataCache) save(fileName string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, b, 0644)
+}
+
+// imageMetadataFor resolves tag to its digest and returns the metadata of the
+// digest, only a HEAD request is needed if the digest is already cached
+func imageMetadataFor(ctx context.Context, repo, tag string) (imageMetadata, error) {
+	dgst, err := manifestDigest(ctx, repo, tag)
+	if err != nil {
+		return imageMetadata{}, fmt.Errorf("digest of %s: %s", tag, err)
+	}
+	return imageMetadataForDigest(ctx, repo, dgst)
+}
+
+func imageMetadataForDigest(ctx context.Context, repo string, dgst digest.Digest) (imageMetadata, error) {
+	if m, ok := metadata.get(dgst); ok {
+		return m, nil
+	}
+
+	payload, mediaType, err := getManifest(ctx, repo, dgst.String())
+	if err != nil {
+		return imageMetadata{}, fmt.Errorf("manifest %s: %s", dgst, err)
+	}
+	mani, err := parseManifest(mediaType, payload)
+	if err != nil {
+		return imageMetadata{}, fmt.Errorf("manifest %s: %s", dgst, err)
+	}
+
+	m := imageMetadata{MediaType: mani.MediaType}
+	switch {
+	case isIndex(mani.MediaType):
+		// an index has no config, it is as old as its first image
+		if len(mani.Manifests) == 0 {
+			return imageMetadata{}, fmt.Errorf("index %s is empty", dgst)
+		}
+		child, err := imageMetadataForDigest(ctx, repo, mani.Manifests[0].Digest)
+		if err != nil {
+			return imageMetadata{}, err
+		}
+		m.Created = child.Created
+		m.Labels = child.Labels
+		for _, c := range mani.Manifests {
+			m.Size += c.Size
+		}
+	case mani.Config != nil:
+		config, err := fetchImageConfig(ctx, repo, mani.Config.Digest)
+		if err != nil {
+			return imageMetadata{}, err
+		}
+		m.Created = config.Created
+		m.Labels = config.Config.Labels
+		for _, blob := range mani.blobs() {
+			m.Size += blob.Size
+		}
+	default:
+		return imageMetadata{}, fmt.Errorf("manifest %s has no config", dgst)
+	}
+
+	metadata.put(dgst, m)
+	return m, nil
+}
+
+func fetchImageConfig(ctx context.Context, repo string, dgst digest.Digest) (imageConfig, error) {
+	config := imageConfig{}
+
+	reader, err := client(ctx).DownloadLayer(repo, dgst)
+	if err != nil {
+		return config, fmt.Errorf("config %s: %s", dgst, err)
+	}
+	defer reader.Close()
+
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return config, fmt.Errorf("config %s: %s", dgst, err)
+	}
+
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("config %s: %s", dgst, err)
+	}
+	return config, nil
+}
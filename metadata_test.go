@@ -0,0 +1,121 @@
+// docker-unregstriy-untagger :- tests for the image metadata cache
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataCacheTrim(t *testing.T) {
+	c := newMetadataCache(2)
+	c.put("sha256:01", imageMetadata{Size: 1})
+	time.Sleep(time.Millisecond)
+	c.put("sha256:02", imageMetadata{Size: 2})
+	time.Sleep(time.Millisecond)
+	c.get("sha256:01")
+	time.Sleep(time.Millisecond)
+	c.put("sha256:03", imageMetadata{Size: 3})
+
+	_, ok := c.get("sha256:02")
+	assert.False(t, ok, "least recently used entry should be dropped")
+	m, ok := c.get("sha256:01")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), m.Size)
+	_, ok = c.get("sha256:03")
+	assert.True(t, ok)
+}
+
+func TestMetadataCacheTrimBatch(t *testing.T) {
+	c := newMetadataCache(100)
+	for i := 0; i < 100; i++ {
+		c.put(digest.FromString(strconv.Itoa(i)), imageMetadata{Size: int64(i)})
+	}
+	assert.Equal(t, 100, len(c.Entries))
+
+	// growing over max drops a tenth, the next puts need no trim
+	c.put(digest.FromString("100"), imageMetadata{Size: 100})
+	assert.Equal(t, 90, len(c.Entries))
+	for i := 101; i < 111; i++ {
+		c.put(digest.FromString(strconv.Itoa(i)), imageMetadata{Size: int64(i)})
+	}
+	assert.Equal(t, 100, len(c.Entries))
+	_, ok := c.get(digest.FromString("110"))
+	assert.True(t, ok)
+}
+
+func TestMetadataCacheSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "cache.json")
+
+	c, err := loadMetadataCache(fileName, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, c.Entries)
+
+	created := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	c.put("sha256:01", imageMetadata{Created: created, Size: 5, Labels: map[string]string{"a": "b"}, MediaType: mediaTypeOCIManifest})
+	assert.NoError(t, c.save(fileName))
+
+	c, err = loadMetadataCache(fileName, 0)
+	assert.NoError(t, err)
+	m, ok := c.get("sha256:01")
+	assert.True(t, ok)
+	assert.Equal(t, created, m.Created)
+	assert.Equal(t, int64(5), m.Size)
+	assert.Equal(t, map[string]string{"a": "b"}, m.Labels)
+	assert.Equal(t, mediaTypeOCIManifest, m.MediaType)
+}
+
+func TestImageMetadataFor(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	oldMetadata := metadata
+	defer func() { metadata = oldMetadata }()
+	metadata = newMetadataCache(0)
+
+	config := f.addBlob("app", []byte(`{"created":"2017-03-01T00:00:00Z","config":{"Labels":{"team":"blue"}}}`))
+	image := []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `",` +
+		`"config":{"digest":"` + config.String() + `","size":10},"layers":[{"digest":"sha256:0a","size":100}]}`)
+	imageDigest := f.addManifest("app", mediaTypeOCIManifest, image, "build_1")
+	index := []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIIndex + `",` +
+		`"manifests":[{"digest":"` + imageDigest.String() + `","size":` + strconv.Itoa(len(image)) + `}]}`)
+	f.addManifest("app", mediaTypeOCIIndex, index, "multi_1")
+
+	m, err := imageMetadataFor(context.Background(), "app", "build_1")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), m.Created)
+	assert.Equal(t, int64(110), m.Size)
+	assert.Equal(t, map[string]string{"team": "blue"}, m.Labels)
+	assert.Equal(t, mediaTypeOCIManifest, m.MediaType)
+
+	// the second lookup only needs the digest of the tag
+	f.requests = nil
+	_, err = imageMetadataFor(context.Background(), "app", "build_1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"HEAD /v2/app/manifests/build_1"}, f.requests)
+
+	m, err = imageMetadataFor(context.Background(), "app", "multi_1")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), m.Created)
+	assert.Equal(t, int64(len(image)), m.Size)
+	assert.Equal(t, mediaTypeOCIIndex, m.MediaType)
+
+	_, err = imageMetadataForDigest(context.Background(), "app", digest.FromString("missing"))
+	assert.Error(t, err)
+}
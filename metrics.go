@@ -0,0 +1,241 @@
+// docker-unregstriy-untagger :- prometheus metrics
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is a family of values in the prometheus text format
+type metric struct {
+	sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	values map[string]float64
+	counts map[string][]uint64
+	sums   map[string]float64
+}
+
+func newMetric(kind, name, help string, labels ...string) *metric {
+	return &metric{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+		counts: make(map[string][]uint64),
+		sums:   make(map[string]float64),
+	}
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric("histogram", name, help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// add increases a counter or gauge
+func (m *metric) add(v float64, labelValues ...string) {
+	m.Lock()
+	m.values[labelKey(labelValues)] += v
+	m.Unlock()
+}
+
+// set overwrites a gauge
+func (m *metric) set(v float64, labelValues ...string) {
+	m.Lock()
+	m.values[labelKey(labelValues)] = v
+	m.Unlock()
+}
+
+// observe adds a value to a histogram
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := labelKey(labelValues)
+	counts, ok := m.counts[key]
+	if !ok {
+		counts = make([]uint64, len(m.buckets)+1)
+		m.counts[key] = counts
+	}
+	for i, bound := range m.buckets {
+		if v <= bound {
+			counts[i]++
+		}
+	}
+	counts[len(m.buckets)]++
+	m.sums[key] += v
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metric) labelString(key string, extra ...string) string {
+	pairs := make([]string, 0)
+	if len(m.labels) != 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, m.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	if m.kind != "histogram" {
+		keys := make([]string, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelString(key), formatFloat(m.values[key]))
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(m.counts))
+	for key := range m.counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		counts := m.counts[key]
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(key, "le", formatFloat(bound)), counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(key, "le", "+Inf"), counts[len(m.buckets)])
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelString(key), formatFloat(m.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelString(key), counts[len(m.buckets)])
+	}
+}
+
+var (
+	metricTagsScanned = newMetric("counter", "untagger_tags_scanned_total",
+		"Number of tags that were evaluated.", "registry", "repository")
+	metricCandidates = newMetric("counter", "untagger_candidates_total",
+		"Number of tags that were marked for removal.", "registry", "repository")
+	metricDeletions = newMetric("counter", "untagger_deletions_total",
+		"Number of manifest deletions by result.", "registry", "repository", "result")
+	metricReclaimedBytes = newMetric("counter", "untagger_reclaimed_bytes_estimated_total",
+		"Estimated bytes of config and layers referenced by removed manifests.", "registry", "repository")
+	metricRequests = newMetric("counter", "untagger_registry_requests_total",
+		"Number of requests against the registry by method and status code.", "registry", "method", "code")
+	metricRequestDuration = newHistogram("untagger_registry_request_duration_seconds",
+		"Latency of requests against the registry.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "registry", "method")
+	metricRepositoryDuration = newMetric("gauge", "untagger_repository_run_duration_seconds",
+		"Duration of the last run per repository.", "registry", "repository")
+	metricRunDuration = newMetric("gauge", "untagger_run_duration_seconds",
+		"Duration of the last run over all repositories.")
+	metricLastRun = newMetric("gauge", "untagger_last_run_timestamp_seconds",
+		"Unix time the last run finished.")
+
+	allMetrics = []*metric{
+		metricTagsScanned,
+		metricCandidates,
+		metricDeletions,
+		metricReclaimedBytes,
+		metricRequests,
+		metricRequestDuration,
+		metricRepositoryDuration,
+		metricRunDuration,
+		metricLastRun,
+	}
+)
+
+func writeMetrics(w io.Writer) {
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+// serveMetrics exposes all metrics on /metrics
+func serveMetrics(listen string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	go func() {
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			fmt.Println("ERROR: ", err)
+		}
+	}()
+}
+
+// writeMetricsFile writes all metrics for the node-exporter textfile
+// collector. The file is renamed into place so it is never read half written.
+func writeMetricsFile(fileName string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), ".untagger")
+	if err != nil {
+		return err
+	}
+	writeMetrics(tmp)
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// metricsTransport records latency and status codes of every request. It is
+// the innermost transport so it sees the real status codes before
+// registry.ErrorTransport turns them into errors.
+type metricsTransport struct {
+	registry  string
+	Transport http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	resp, err := t.Transport.RoundTrip(req)
+	metricRequestDuration.observe(time.Since(started).Seconds(), t.registry, req.Method)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	metricRequests.add(1, t.registry, req.Method, code)
+	return resp, err
+}
@@ -0,0 +1,97 @@
+// docker-unregstriy-untagger :- tests for prometheus metrics
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricWrite(t *testing.T) {
+	counter := newMetric("counter", "test_total", "A counter.", "repository", "result")
+	counter.add(1, "b", "success")
+	counter.add(2, "a", "error")
+	counter.add(1, "a", "error")
+	counter.add(1, `q"uote`, "success")
+
+	b := &bytes.Buffer{}
+	counter.write(b)
+	assert.Equal(t, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{repository="a",result="error"} 3
+test_total{repository="b",result="success"} 1
+test_total{repository="q\"uote",result="success"} 1
+`, b.String())
+
+	gauge := newMetric("gauge", "test_seconds", "A gauge.")
+	gauge.set(5)
+	gauge.set(1.5)
+
+	b.Reset()
+	gauge.write(b)
+	assert.Equal(t, `# HELP test_seconds A gauge.
+# TYPE test_seconds gauge
+test_seconds 1.5
+`, b.String())
+
+	histogram := newHistogram("test_duration_seconds", "A histogram.", []float64{0.1, 1}, "method")
+	histogram.observe(0.05, "GET")
+	histogram.observe(0.5, "GET")
+	histogram.observe(3, "GET")
+
+	b.Reset()
+	histogram.write(b)
+	assert.Equal(t, `# HELP test_duration_seconds A histogram.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{method="GET",le="0.1"} 1
+test_duration_seconds_bucket{method="GET",le="1"} 2
+test_duration_seconds_bucket{method="GET",le="+Inf"} 3
+test_duration_seconds_sum{method="GET"} 3.55
+test_duration_seconds_count{method="GET"} 3
+`, b.String())
+}
+
+func TestMetricsTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	before := metricRequests.values[labelKey([]string{"eu", "HEAD", "404"})]
+
+	client := &http.Client{Transport: &metricsTransport{registry: "eu", Transport: http.DefaultTransport}}
+	resp, err := client.Head(srv.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, before+1, metricRequests.values[labelKey([]string{"eu", "HEAD", "404"})])
+	assert.NotEmpty(t, metricRequestDuration.counts[labelKey([]string{"eu", "HEAD"})])
+}
+
+func TestWriteMetricsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "untagger.prom")
+	assert.NoError(t, writeMetricsFile(fileName))
+
+	b, err := ioutil.ReadFile(fileName)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "# TYPE untagger_deletions_total counter")
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
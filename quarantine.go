@@ -0,0 +1,131 @@
+// docker-unregstriy-untagger :- quarantine before deletion
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+type quarantineEntry struct {
+	Digest digest.Digest `json:"digest"`
+	Since  time.Time     `json:"since"`
+}
+
+// quarantine remembers since when a tag is marked for deletion. A tag is only
+// removed once it was marked for the whole grace period with the same digest
+type quarantine struct {
+	sync.Mutex
+	Repositories map[string]map[string]quarantineEntry `json:"repositories"`
+
+	grace time.Duration
+}
+
+func newQuarantine(grace time.Duration) *quarantine {
+	return &quarantine{
+		Repositories: make(map[string]map[string]quarantineEntry),
+		grace:        grace,
+	}
+}
+
+// loadQuarantine reads the state file, a missing file is an empty quarantine
+func loadQuarantine(fileName string, grace time.Duration) (*quarantine, error) {
+	q := newQuarantine(grace)
+
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, q); err != nil {
+		return nil, err
+	}
+	if q.Repositories == nil {
+		q.Repositories = make(map[string]map[string]quarantineEntry)
+	}
+	return q, nil
+}
+
+func (q *quarantine) save(fileName string) error {
+	q.Lock()
+	defer q.Unlock()
+
+	b, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, b, 0644)
+}
+
+// nextDue returns the first time a tag of repo leaves the quarantine
+func (q *quarantine) nextDue(repo string) time.Time {
+	q.Lock()
+	defer q.Unlock()
+
+	var due time.Time
+	for _, entry := range q.Repositories[repo] {
+		if t := entry.Since.Add(q.grace); due.IsZero() || t.Before(due) {
+			due = t
+		}
+	}
+	return due
+}
+
+// update replaces the quarantine of repo with the current candidates. Tags that
+// are no longer candidates or point to another digest leave the quarantine.
+// It returns the candidates whose grace period is over and the tags that stay
+// in quarantine. A digest is only due if all of its tags are due.
+func (q *quarantine) update(repo string, tags []string, digests []digest.Digest, now time.Time) ([]string, []digest.Digest, []string) {
+	q.Lock()
+	defer q.Unlock()
+
+	old := q.Repositories[repo]
+	entries := make(map[string]quarantineEntry)
+	pending := make(map[digest.Digest]bool)
+
+	for i, tag := range tags {
+		entry, ok := old[tag]
+		if !ok || entry.Digest != digests[i] {
+			entry = quarantineEntry{Digest: digests[i], Since: now}
+		}
+		entries[tag] = entry
+
+		if now.Sub(entry.Since) < q.grace {
+			pending[digests[i]] = true
+		}
+	}
+
+	if len(entries) == 0 {
+		delete(q.Repositories, repo)
+	} else {
+		q.Repositories[repo] = entries
+	}
+
+	dueTags := make([]string, 0)
+	dueDigests := make([]digest.Digest, 0)
+	held := make([]string, 0)
+	for i, tag := range tags {
+		if pending[digests[i]] {
+			held = append(held, tag)
+			continue
+		}
+		dueTags = append(dueTags, tag)
+		dueDigests = append(dueDigests, digests[i])
+	}
+	sort.Strings(held)
+
+	return dueTags, dueDigests, held
+}
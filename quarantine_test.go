@@ -0,0 +1,125 @@
+// docker-unregstriy-untagger :- tests for the quarantine
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuarantineUpdate(t *testing.T) {
+	now := time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC)
+	old := now.Add(-72 * time.Hour)
+	recent := now.Add(-1 * time.Hour)
+
+	var tests = []struct {
+		inState      map[string]quarantineEntry
+		inTags       []string
+		inDigests    []digest.Digest
+		outTags      []string
+		outDigests   []digest.Digest
+		outHeld      []string
+		outStateTags []string
+	}{
+		{
+			// new candidates enter the quarantine
+			map[string]quarantineEntry{},
+			[]string{"build_1"},
+			[]digest.Digest{"sha256:01"},
+			[]string{},
+			[]digest.Digest{},
+			[]string{"build_1"},
+			[]string{"build_1"},
+		}, {
+			// grace period is over
+			map[string]quarantineEntry{"build_1": {Digest: "sha256:01", Since: old}},
+			[]string{"build_1"},
+			[]digest.Digest{"sha256:01"},
+			[]string{"build_1"},
+			[]digest.Digest{"sha256:01"},
+			[]string{},
+			[]string{"build_1"},
+		}, {
+			// tag was pushed again
+			map[string]quarantineEntry{"build_1": {Digest: "sha256:01", Since: old}},
+			[]string{"build_1"},
+			[]digest.Digest{"sha256:02"},
+			[]string{},
+			[]digest.Digest{},
+			[]string{"build_1"},
+			[]string{"build_1"},
+		}, {
+			// tag is no longer a candidate
+			map[string]quarantineEntry{"build_1": {Digest: "sha256:01", Since: old}},
+			[]string{},
+			[]digest.Digest{},
+			[]string{},
+			[]digest.Digest{},
+			[]string{},
+			nil,
+		}, {
+			// digest is only due if all of its tags are due
+			map[string]quarantineEntry{
+				"build_1": {Digest: "sha256:01", Since: old},
+				"build_2": {Digest: "sha256:01", Since: recent},
+				"build_3": {Digest: "sha256:03", Since: old},
+			},
+			[]string{"build_1", "build_2", "build_3"},
+			[]digest.Digest{"sha256:01", "sha256:01", "sha256:03"},
+			[]string{"build_3"},
+			[]digest.Digest{"sha256:03"},
+			[]string{"build_1", "build_2"},
+			[]string{"build_1", "build_2", "build_3"},
+		},
+	}
+
+	for i, tt := range tests {
+		q := newQuarantine(48 * time.Hour)
+		q.Repositories["repo"] = tt.inState
+
+		tags, digests, held := q.update("repo", tt.inTags, tt.inDigests, now)
+		assert.Equal(t, tt.outTags, tags, "TestQuarantineUpdate "+strconv.Itoa(i+1)+" tags should be equal")
+		assert.Equal(t, tt.outDigests, digests, "TestQuarantineUpdate "+strconv.Itoa(i+1)+" digests should be equal")
+		assert.Equal(t, tt.outHeld, held, "TestQuarantineUpdate "+strconv.Itoa(i+1)+" held tags should be equal")
+
+		var stateTags []string
+		for _, tag := range tt.inTags {
+			if _, ok := q.Repositories["repo"][tag]; ok {
+				stateTags = append(stateTags, tag)
+			}
+		}
+		assert.Equal(t, tt.outStateTags, stateTags, "TestQuarantineUpdate "+strconv.Itoa(i+1)+" state should be equal")
+	}
+}
+
+func TestQuarantineSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "quarantine.json")
+
+	q, err := loadQuarantine(fileName, time.Hour)
+	assert.NoError(t, err)
+	assert.Empty(t, q.Repositories)
+
+	since := time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC)
+	q.update("repo", []string{"build_1"}, []digest.Digest{"sha256:01"}, since)
+	assert.NoError(t, q.save(fileName))
+
+	q, err = loadQuarantine(fileName, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]quarantineEntry{
+		"repo": {"build_1": {Digest: "sha256:01", Since: since}},
+	}, q.Repositories)
+}
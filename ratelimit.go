@@ -0,0 +1,118 @@
+// docker-unregstriy-untagger :- request rate limiting
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limiter caps the requests per second and the concurrent requests
+type limiter struct {
+	slots chan bool
+
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(requestsPerSecond float64, concurrency int) *limiter {
+	l := &limiter{}
+	if requestsPerSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	if concurrency > 0 {
+		l.slots = make(chan bool, concurrency)
+	}
+	return l
+}
+
+// wait blocks until a request may be sent, every successful wait needs a release
+func (l *limiter) wait(ctx context.Context) error {
+	if l.slots != nil {
+		select {
+		case l.slots <- true:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if l.interval == 0 {
+		return nil
+	}
+
+	// requests are spaced evenly, every request reserves the next free point in time
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.release()
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+var (
+	limitersMutex sync.Mutex
+	limiters      = make(map[string]*limiter)
+)
+
+// limiterFor returns the limiter of a registry host, all clients of the same
+// host share it, even across runs and repositories
+func limiterFor(host string, requestsPerSecond float64, concurrency int) *limiter {
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+
+	l, ok := limiters[host]
+	if !ok {
+		l = newLimiter(requestsPerSecond, concurrency)
+		limiters[host] = l
+	}
+	return l
+}
+
+// limitTransport applies a limiter to every request against host. A request
+// counts as running until its response headers arrived.
+type limitTransport struct {
+	host      string
+	limiter   *limiter
+	Transport http.RoundTripper
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.Transport.RoundTrip(req)
+	}
+
+	if err := t.limiter.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	defer t.limiter.release()
+	return t.Transport.RoundTrip(req)
+}
@@ -0,0 +1,93 @@
+// docker-unregstriy-untagger :- tests for request rate limiting
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterRate(t *testing.T) {
+	l := newLimiter(100, 0)
+
+	started := time.Now()
+	for i := 0; i < 11; i++ {
+		assert.NoError(t, l.wait(context.Background()))
+		l.release()
+	}
+	// the first request is free, the other 10 are spaced by 10ms
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond {
+		t.Errorf("11 requests with 100/s took %s, want at least 100ms", elapsed)
+	}
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	l := newLimiter(0, 1)
+	assert.NoError(t, l.wait(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l.wait(ctx))
+
+	l.release()
+	assert.NoError(t, l.wait(context.Background()))
+	l.release()
+}
+
+func TestLimiterFor(t *testing.T) {
+	assert.True(t, limiterFor("a.example.com", 1, 1) == limiterFor("a.example.com", 5, 5))
+	assert.False(t, limiterFor("a.example.com", 1, 1) == limiterFor("b.example.com", 1, 1))
+}
+
+func TestLimitTransport(t *testing.T) {
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &limitTransport{
+		host:      u.Host,
+		limiter:   newLimiter(0, 2),
+		Transport: http.DefaultTransport,
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			assert.NoError(t, err)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, maxRunning <= 2, "at most 2 requests should run at once")
+}
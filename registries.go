@@ -0,0 +1,258 @@
+// docker-unregstriy-untagger :- several registries in one config
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v1"
+)
+
+// registryConfig is one entry of registries in config.yml, every field that
+// is set overrides the top level config
+type registryConfig struct {
+	Name                  string  `yaml:"name"`
+	Type                  string  `yaml:"type"`
+	Host                  string  `yaml:"host"`
+	User                  string  `yaml:"user"`
+	Password              string  `yaml:"password"`
+	Insecure              *bool   `yaml:"insecure"`
+	CAFile                string  `yaml:"caFile"`
+	CertFile              string  `yaml:"certFile"`
+	KeyFile               string  `yaml:"keyFile"`
+	DeleteMode            string  `yaml:"deleteMode"`
+	PoolSize              int     `yaml:"poolSize"`
+	ParallelDownloads     int     `yaml:"parallelDownloads"`
+	RequestsPerSecond     float64 `yaml:"requestsPerSecond"`
+	MaxConcurrentRequests int     `yaml:"maxConcurrentRequests"`
+	Rules                 string  `yaml:"rules"`
+	BackupDir             string  `yaml:"backupDir"`
+	QuarantineFile        string  `yaml:"quarantineFile"`
+	StateFile             string  `yaml:"stateFile"`
+}
+
+// target is a registry with its own config, rules and state
+type target struct {
+	name        string
+	cfg         config
+	rules       rule
+	rulesHash   string
+	quarantined *quarantine
+	incremental *incrementalState
+}
+
+// targets are all registries of the config
+var targets []*target
+
+// perRegistryFile adds the name of a registry to a state file, so several
+// registries do not share their state
+func perRegistryFile(fileName, name string) string {
+	if fileName == "" {
+		return ""
+	}
+	ext := filepath.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext) + "-" + name + ext
+}
+
+// registryTargets returns the config of every registry. Without registries
+// the top level config is the only registry.
+func registryTargets(base config, rulesFileName string) ([]config, []string, error) {
+	if len(base.Registries) == 0 {
+		return []config{base}, []string{rulesFileName}, nil
+	}
+
+	configs := make([]config, 0, len(base.Registries))
+	rulesFiles := make([]string, 0, len(base.Registries))
+	names := make(map[string]bool)
+	for i, r := range base.Registries {
+		if r.Name == "" {
+			return nil, nil, fmt.Errorf("registry %d needs a name", i+1)
+		}
+		if names[r.Name] {
+			return nil, nil, fmt.Errorf("registry %q is configured twice", r.Name)
+		}
+		names[r.Name] = true
+
+		c := base
+		c.Registries = nil
+		c.Name = r.Name
+		if r.Type != "" {
+			c.Type = r.Type
+		}
+		if r.Host != "" {
+			c.Host = r.Host
+		}
+		if r.User != "" {
+			c.User = r.User
+		}
+		if r.Password != "" {
+			c.Password = r.Password
+		}
+		if r.Insecure != nil {
+			c.Insecure = *r.Insecure
+		}
+		if r.CAFile != "" {
+			c.CAFile = r.CAFile
+		}
+		if r.CertFile != "" || r.KeyFile != "" {
+			c.CertFile, c.KeyFile = r.CertFile, r.KeyFile
+		}
+		if r.DeleteMode != "" {
+			c.DeleteMode = r.DeleteMode
+		}
+		if r.PoolSize != 0 {
+			c.PoolSize = r.PoolSize
+		}
+		if r.ParallelDownloads != 0 {
+			c.ParallelDownloads = r.ParallelDownloads
+		}
+		if r.RequestsPerSecond != 0 {
+			c.RequestsPerSecond = r.RequestsPerSecond
+		}
+		if r.MaxConcurrentRequests != 0 {
+			c.MaxConcurrentRequests = r.MaxConcurrentRequests
+		}
+
+		c.BackupDir = r.BackupDir
+		if c.BackupDir == "" && base.BackupDir != "" {
+			c.BackupDir = filepath.Join(base.BackupDir, r.Name)
+		}
+		c.QuarantineFile = r.QuarantineFile
+		if c.QuarantineFile == "" {
+			c.QuarantineFile = perRegistryFile(base.QuarantineFile, r.Name)
+		}
+		c.StateFile = r.StateFile
+		if c.StateFile == "" {
+			c.StateFile = perRegistryFile(base.StateFile, r.Name)
+		}
+
+		rulesFile := r.Rules
+		if rulesFile == "" {
+			rulesFile = rulesFileName
+		}
+		configs = append(configs, c)
+		rulesFiles = append(rulesFiles, rulesFile)
+	}
+	if err := checkHostLimits(configs); err != nil {
+		return nil, nil, err
+	}
+	return configs, rulesFiles, nil
+}
+
+// checkHostLimits rejects registries on the same host with different
+// limits, all clients of a host share one limiter
+func checkHostLimits(configs []config) error {
+	byHost := make(map[string]config)
+	for _, c := range configs {
+		u, err := url.Parse(c.Host)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		other, ok := byHost[u.Host]
+		if !ok {
+			byHost[u.Host] = c
+			continue
+		}
+		if other.RequestsPerSecond != c.RequestsPerSecond || other.MaxConcurrentRequests != c.MaxConcurrentRequests {
+			return fmt.Errorf("registries %q and %q share the host %s, but set different requestsPerSecond or maxConcurrentRequests", other.Name, c.Name, u.Host)
+		}
+	}
+	return nil
+}
+
+// loadRules reads and verifies a rules file, it also returns the hash of the
+// file for the incremental state
+func loadRules(fileName string) (rule, string, error) {
+	r := rule{}
+	rulesFile, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return r, "", fmt.Errorf("rules file %s is missing: %s", fileName, err)
+	}
+
+	if err := yaml.Unmarshal(rulesFile, &r); err != nil {
+		return r, "", fmt.Errorf("rules file %s is malformed: %s", fileName, err)
+	}
+	sort.Strings(r.Repositories)
+
+	if err := verifyRules(&r); err != nil {
+		return r, "", fmt.Errorf("%s: %s", fileName, err)
+	}
+	return r, digest.FromBytes(rulesFile).String(), nil
+}
+
+// loadTarget reads the rules and state of a registry
+func loadTarget(c config, rulesFileName string) (*target, error) {
+	if err := checkType(&c); err != nil {
+		return nil, err
+	}
+
+	t := &target{name: c.Name, cfg: c}
+	var err error
+	t.rules, t.rulesHash, err = loadRules(rulesFileName)
+	if err != nil {
+		return nil, err
+	}
+	switch c.DeleteMode {
+	case "", deleteModeTag, deleteModeDigest:
+	default:
+		return nil, fmt.Errorf("deleteMode %s is unknown, use %s or %s", c.DeleteMode, deleteModeTag, deleteModeDigest)
+	}
+	if c.Type == typeGitlab && t.rules.ArchiveDir != "" {
+		return nil, fmt.Errorf("archiveDir is not supported for gitlab")
+	}
+
+	if c.QuarantineFile != "" {
+		t.quarantined, err = loadQuarantine(c.QuarantineFile, time.Duration(t.rules.QuarantineDays)*24*time.Hour)
+		if err != nil {
+			return nil, fmt.Errorf("quarantine file is malformed: %s", err)
+		}
+	}
+
+	if c.StateFile != "" {
+		t.incremental, err = loadIncrementalState(c.StateFile)
+		if err != nil {
+			return nil, fmt.Errorf("state file is malformed: %s", err)
+		}
+	}
+	return t, nil
+}
+
+// use points the globals the rules work with at a registry
+func use(t *target) {
+	cfg = t.cfg
+	rules = t.rules
+	rulesHash = t.rulesHash
+	quarantined = t.quarantined
+	incremental = t.incremental
+	hub = nil
+
+	pool = make(chan bool, cfg.PoolSize)
+	downloads = make(chan bool, cfg.ParallelDownloads)
+}
+
+// targetNamed returns the registry to restore into
+func targetNamed(name string) (*target, error) {
+	if name == "" && len(targets) == 1 {
+		return targets[0], nil
+	}
+	for _, t := range targets {
+		if t.name == name {
+			return t, nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("select one of the registries with -registry")
+	}
+	return nil, fmt.Errorf("registry %q is not configured", name)
+}
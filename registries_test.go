@@ -0,0 +1,205 @@
+// docker-unregstriy-untagger :- tests for several registries
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v1"
+)
+
+func TestPerRegistryFile(t *testing.T) {
+	var tests = []struct {
+		in   string
+		name string
+		out  string
+	}{
+		{"", "eu", ""},
+		{"/var/lib/untagger/state.json", "eu", "/var/lib/untagger/state-eu.json"},
+		{"state", "us", "state-us"},
+	}
+	for i, tt := range tests {
+		assert.Equal(t, tt.out, perRegistryFile(tt.in, tt.name), "TestPerRegistryFile "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestRegistryTargets(t *testing.T) {
+	yes, no := true, false
+	base := config{
+		Host:           "https://primary",
+		User:           "user",
+		PoolSize:       3,
+		StateFile:      "state.json",
+		BackupDir:      "backup",
+		QuarantineFile: "quarantine.json",
+	}
+
+	configs, rulesFiles, err := registryTargets(base, "rules.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, []config{base}, configs)
+	assert.Equal(t, []string{"rules.yml"}, rulesFiles)
+
+	base.Registries = []registryConfig{
+		{Name: "primary", DeleteMode: deleteModeTag},
+		{Name: "eu", Type: typeHarbor, Host: "https://eu", User: "robot", Insecure: &yes, CAFile: "eu.pem", PoolSize: 1, Rules: "eu.yml", StateFile: "eu.json"},
+	}
+	configs, rulesFiles, err = registryTargets(base, "rules.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rules.yml", "eu.yml"}, rulesFiles)
+
+	assert.Equal(t, "primary", configs[0].Name)
+	assert.Equal(t, "https://primary", configs[0].Host)
+	assert.Equal(t, "state-primary.json", configs[0].StateFile)
+	assert.Equal(t, "backup/primary", configs[0].BackupDir)
+	assert.Equal(t, deleteModeTag, configs[0].DeleteMode)
+	assert.Nil(t, configs[0].Registries)
+
+	assert.Equal(t, "https://eu", configs[1].Host)
+	assert.Equal(t, typeHarbor, configs[1].Type)
+	assert.Equal(t, "robot", configs[1].User)
+	assert.Equal(t, 1, configs[1].PoolSize)
+	assert.True(t, configs[1].Insecure)
+	assert.Equal(t, "eu.pem", configs[1].CAFile)
+	assert.False(t, configs[0].Insecure)
+
+	assert.Equal(t, "eu.json", configs[1].StateFile)
+	assert.Equal(t, "quarantine-eu.json", configs[1].QuarantineFile)
+
+	// an entry turns off insecure of the top level config
+	base.Insecure, base.CAFile = true, "ca.pem"
+	base.Registries = []registryConfig{{Name: "strict", Insecure: &no}, {Name: "inherited"}}
+	configs, _, err = registryTargets(base, "rules.yml")
+	assert.NoError(t, err)
+	assert.False(t, configs[0].Insecure)
+	assert.True(t, configs[1].Insecure)
+	assert.Equal(t, "ca.pem", configs[0].CAFile)
+
+	var parsed config
+	assert.NoError(t, yaml.Unmarshal([]byte("insecure: true\nregistries:\n  - name: a\n    insecure: false\n  - name: b\n"), &parsed))
+	assert.Equal(t, &no, parsed.Registries[0].Insecure)
+	assert.Nil(t, parsed.Registries[1].Insecure)
+	base.Insecure, base.CAFile = false, ""
+
+	base.Registries = []registryConfig{{Name: "a"}, {Name: "a"}}
+	_, _, err = registryTargets(base, "rules.yml")
+	assert.Error(t, err)
+
+	base.Registries = []registryConfig{{Host: "https://unnamed"}}
+	_, _, err = registryTargets(base, "rules.yml")
+	assert.Error(t, err)
+
+	// registries on one host share the limiter and need the same limits
+	base.RequestsPerSecond = 10
+	base.Registries = []registryConfig{{Name: "a"}, {Name: "b", MaxConcurrentRequests: 5}}
+	_, _, err = registryTargets(base, "rules.yml")
+	assert.Error(t, err)
+	base.Registries = []registryConfig{{Name: "a"}, {Name: "b", RequestsPerSecond: 10}, {Name: "c", Host: "https://other", RequestsPerSecond: 1}}
+	_, _, err = registryTargets(base, "rules.yml")
+	assert.NoError(t, err)
+}
+
+func TestRunRegistries(t *testing.T) {
+	oldTargets := targets
+	defer func() {
+		targets = oldTargets
+		use(targets[0])
+	}()
+
+	r := rule{
+		Repositories:       []string{"app"},
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+	}
+	manifest := func(i int) []byte {
+		return []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `","config":{"digest":"sha256:0` + strconv.Itoa(i) + `"}}`)
+	}
+
+	primary, eu := newFakeRegistry(), newFakeRegistry()
+	for i := 1; i <= 3; i++ {
+		primary.addManifest("app", schema2.MediaTypeManifest, manifest(i), "build_"+strconv.Itoa(i))
+		eu.addManifest("app", schema2.MediaTypeManifest, manifest(i), "build_"+strconv.Itoa(i))
+	}
+	primarySrv, euSrv := startFakeRegistry(primary), startFakeRegistry(eu)
+	defer primarySrv.Close()
+	defer euSrv.Close()
+
+	targets = []*target{
+		{name: "primary", cfg: config{Name: "primary", Type: typeRegistry, Host: primarySrv.URL, PoolSize: 1, ParallelDownloads: 2}, rules: r},
+		{name: "broken", cfg: config{Name: "broken", Type: typeRegistry, Host: "http://127.0.0.1:1", PoolSize: 1, ParallelDownloads: 2}, rules: r},
+		{name: "eu", cfg: config{Name: "eu", Type: typeRegistry, Host: euSrv.URL, PoolSize: 1, ParallelDownloads: 2}, rules: r},
+	}
+
+	// the broken registry does not stop the others
+	summary, err := run(context.Background(), context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 4, summary.Removed)
+	assert.Equal(t, 3, summary.Repositories)
+	assert.Equal(t, []string{"broken"}, summary.Failed)
+	assert.Equal(t, "primary:digest,eu:digest", summary.DeleteMode)
+	assert.Equal(t, exitPartialFailure, summary.exitCode())
+	assert.Equal(t, []string{"build_3"}, primary.tagsOf("app"))
+	assert.Equal(t, []string{"build_3"}, eu.tagsOf("app"))
+}
+
+func TestRegistryTLSConfig(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	// the failed handshakes are expected
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644))
+	empty := filepath.Join(dir, "empty.pem")
+	assert.NoError(t, ioutil.WriteFile(empty, nil, 0644))
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+
+	var tests = []struct {
+		cfg       config
+		configErr bool
+		ok        bool
+	}{
+		{config{}, false, false},
+		{config{CAFile: caFile}, false, true},
+		{config{Insecure: true}, false, true},
+		{config{CAFile: empty}, true, false},
+		{config{CAFile: filepath.Join(dir, "missing.pem")}, true, false},
+		{config{CertFile: caFile}, true, false},
+	}
+	for i, tt := range tests {
+		cfg = tt.cfg
+		cfg.Name = "tls"
+		transport, err := hostTransport(srv.URL)
+		assert.Equal(t, tt.configErr, err != nil, "TestRegistryTLSConfig "+strconv.Itoa(i+1)+" error should be equal")
+		if err != nil {
+			continue
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		assert.Equal(t, tt.ok, err == nil, "TestRegistryTLSConfig "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
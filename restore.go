@@ -0,0 +1,130 @@
+// docker-unregstriy-untagger :- restore removed tags from a backup
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/opencontainers/go-digest"
+)
+
+// sortForRestore orders image manifests before indexes, an index can only be
+// pushed once all of its children exist again. Referrers without tags come
+// last, after their subjects.
+func sortForRestore(entries []backupEntry) {
+	rank := func(e backupEntry) int {
+		switch {
+		case len(e.Tags) == 0:
+			return 2
+		case isIndex(e.MediaType):
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return rank(entries[i]) < rank(entries[j])
+	})
+}
+
+// missingReferences returns all blobs and child manifests of entry that are
+// no longer in the registry
+func missingReferences(ctx context.Context, entry backupEntry) ([]digest.Digest, error) {
+	missing := make([]digest.Digest, 0)
+
+	m, err := parseManifest(entry.MediaType, entry.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range m.Manifests {
+		ok, err := hasManifest(ctx, entry.Repository, child.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, child.Digest)
+		}
+	}
+
+	for _, blob := range m.blobs() {
+		ok, err := client(ctx).HasLayer(entry.Repository, blob.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, blob.Digest)
+		}
+	}
+	return missing, nil
+}
+
+func restoreEntry(ctx context.Context, entry backupEntry) error {
+	if err := entry.Digest.Validate(); err != nil {
+		return err
+	}
+	// schema1 digests are calculated without the signatures
+	if entry.MediaType != schema1.MediaTypeSignedManifest && entry.Digest.Algorithm().FromBytes(entry.Manifest) != entry.Digest {
+		return fmt.Errorf("backup of %s@%s is corrupt", entry.Repository, entry.Digest)
+	}
+
+	missing, err := missingReferences(ctx, entry)
+	if err != nil {
+		return err
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("%s@%s references blobs that are gone: %v", entry.Repository, entry.Digest, missing)
+	}
+
+	// referrers like signatures have no tags, they are pushed by digest
+	if len(entry.Tags) == 0 {
+		return putManifest(ctx, entry.Repository, entry.Digest.String(), entry.MediaType, entry.Manifest)
+	}
+	for _, tag := range entry.Tags {
+		if err := putManifest(ctx, entry.Repository, tag, entry.MediaType, entry.Manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreBackup pushes all manifests of a backup (or only the one matching
+// onlyDigest) under their original tags and returns the number of failures
+func restoreBackup(ctx context.Context, path, onlyDigest string) int {
+	entries, err := loadBackup(path)
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		return 1
+	}
+	sortForRestore(entries)
+
+	failed, found := 0, false
+	for _, entry := range entries {
+		if onlyDigest != "" && entry.Digest.String() != onlyDigest {
+			continue
+		}
+		found = true
+
+		if err := restoreEntry(ctx, entry); err != nil {
+			fmt.Println("ERROR: ", err)
+			failed++
+			continue
+		}
+		if len(entry.Tags) == 0 {
+			fmt.Println(entry.Repository, "Referrer that has been restored: ", entry.Digest)
+			continue
+		}
+		fmt.Println(entry.Repository, "Tags that have been restored: ", entry.Tags)
+	}
+	if onlyDigest != "" && !found {
+		fmt.Println("ERROR: ", onlyDigest, "is not in the backup", path)
+		return 1
+	}
+	return failed
+}
@@ -0,0 +1,92 @@
+// docker-unregstriy-untagger :- tests for restoring backups
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortForRestore(t *testing.T) {
+	tags := []string{"build_1"}
+	entries := []backupEntry{
+		{Digest: "sha256:05", MediaType: mediaTypeOCIManifest},
+		{Digest: "sha256:01", MediaType: mediaTypeOCIIndex, Tags: tags},
+		{Digest: "sha256:02", MediaType: schema2.MediaTypeManifest, Tags: tags},
+		{Digest: "sha256:03", MediaType: mediaTypeManifestList, Tags: tags},
+		{Digest: "sha256:04", MediaType: mediaTypeOCIManifest, Tags: tags},
+	}
+	sortForRestore(entries)
+
+	order := make([]digest.Digest, 0)
+	for _, e := range entries {
+		order = append(order, e.Digest)
+	}
+	assert.Equal(t, []digest.Digest{"sha256:02", "sha256:04", "sha256:01", "sha256:03", "sha256:05"}, order)
+}
+
+func TestRestoreEntry(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	config := f.addBlob("app", []byte(`{"created":"2017-01-01T00:00:00Z"}`))
+	layer := f.addBlob("app", []byte("layer"))
+
+	payload := []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `",` +
+		`"config":{"digest":"` + config.String() + `"},"layers":[{"digest":"` + layer.String() + `"}]}`)
+	entry := backupEntry{
+		Repository: "app",
+		Digest:     digest.FromBytes(payload),
+		MediaType:  mediaTypeOCIManifest,
+		Tags:       []string{"build_1", "build_2"},
+		Manifest:   payload,
+	}
+
+	assert.NoError(t, restoreEntry(context.Background(), entry))
+	assert.Equal(t, []string{"build_1", "build_2"}, f.tagsOf("app"))
+	assert.Equal(t, mediaTypeOCIManifest, f.repo("app").manifests[entry.Digest].mediaType)
+
+	corrupt := entry
+	corrupt.Manifest = []byte("{}")
+	assert.Error(t, restoreEntry(context.Background(), corrupt))
+
+	// a referrer has no tags and is pushed by digest
+	signature := []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `","config":{"digest":"` + config.String() + `"},"layers":[],` +
+		`"subject":{"digest":"` + entry.Digest.String() + `"}}`)
+	referrer := backupEntry{Repository: "app", Digest: digest.FromBytes(signature), MediaType: mediaTypeOCIManifest, Manifest: signature}
+	assert.NoError(t, restoreEntry(context.Background(), referrer))
+	assert.Equal(t, []string{"build_1", "build_2"}, f.tagsOf("app"))
+	assert.Equal(t, signature, f.repo("app").manifests[referrer.Digest].payload)
+
+	delete(f.repo("app").blobs, layer)
+	assert.Error(t, restoreEntry(context.Background(), entry))
+}
+
+func TestRestoreBackupDigest(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	payload := []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `"}`)
+	d := f.addManifest("app", schema2.MediaTypeManifest, payload, "build_1")
+
+	dir, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, backupManifest(context.Background(), &registryBackend{}, dir, "app", d, []string{"build_1"}))
+
+	assert.Equal(t, 0, restoreBackup(context.Background(), dir, d.String()))
+	// a digest that is not in the backup restores nothing and fails
+	assert.Equal(t, 1, restoreBackup(context.Background(), dir, digest.FromString("other").String()))
+}
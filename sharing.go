@@ -0,0 +1,201 @@
+// docker-unregstriy-untagger :- registry wide blob sharing analysis
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// removalPlan collects the manifests and blobs removed by a run per repository
+type removalPlan struct {
+	sync.Mutex
+	manifests map[string][]digest.Digest
+	blobs     map[string]map[digest.Digest]int64
+}
+
+func newRemovalPlan() *removalPlan {
+	return &removalPlan{
+		manifests: make(map[string][]digest.Digest),
+		blobs:     make(map[string]map[digest.Digest]int64),
+	}
+}
+
+// add records the removed manifests of repo, their blobs need to be resolved
+// before they are deleted
+func (p *removalPlan) add(ctx context.Context, b backend, repo string, removed []digest.Digest) error {
+	if len(removed) == 0 {
+		return nil
+	}
+
+	blobs, err := referencedBlobs(ctx, b, repo, removed)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.manifests[repo] = removed
+	p.blobs[repo] = blobs
+	p.Unlock()
+	return nil
+}
+
+type sharedBlob struct {
+	Digest       digest.Digest
+	Size         int64
+	Repositories []string
+}
+
+// sharingReport is the result of a scan over all repositories of the registry
+type sharingReport struct {
+	// Freed are the bytes of removed blobs no kept manifest in any repository uses
+	Freed int64
+	// Shared are the blobs used by the most repositories
+	Shared []sharedBlob
+}
+
+// blobUsage maps every blob to the repositories that keep a manifest using it
+type blobUsage struct {
+	sync.Mutex
+	repos map[digest.Digest]map[string]bool
+	sizes map[digest.Digest]int64
+}
+
+func (u *blobUsage) add(repo string, blobs map[digest.Digest]int64) {
+	u.Lock()
+	defer u.Unlock()
+	for blob, size := range blobs {
+		if u.repos[blob] == nil {
+			u.repos[blob] = make(map[string]bool)
+		}
+		u.repos[blob][repo] = true
+		u.sizes[blob] = size
+	}
+}
+
+// keptBlobs returns the blobs of all tagged manifests in repo that are not removed
+func keptBlobs(ctx context.Context, b backend, repo string, removed []digest.Digest) (map[digest.Digest]int64, error) {
+	infos, err := b.Tags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	digests, err := getDigestForTags(ctx, newListedTags(b, infos), repo, tagNames(infos))
+	if err != nil {
+		return nil, err
+	}
+	_, kept := splitDigests(digests, nil, removed)
+	return referencedBlobs(ctx, b, repo, kept)
+}
+
+// analyzeSharing scans every repository of the registry and compares the
+// blobs of the removal plan with all blobs that are still in use
+func analyzeSharing(ctx context.Context, b backend, plan *removalPlan, top int) (sharingReport, error) {
+	repos, err := b.Repositories(ctx)
+	if err != nil {
+		return sharingReport{}, err
+	}
+
+	usage := &blobUsage{
+		repos: make(map[digest.Digest]map[string]bool),
+		sizes: make(map[digest.Digest]int64),
+	}
+	var firstErr error
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+	scanPool := make(chan bool, cap(pool))
+
+	for _, repo := range repos {
+		wg.Add(1)
+		scanPool <- true
+		go func(repo string) {
+			defer wg.Done()
+			defer func() { <-scanPool }()
+
+			plan.Lock()
+			removed := plan.manifests[repo]
+			plan.Unlock()
+
+			blobs, err := keptBlobs(ctx, b, repo, removed)
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %s", repo, err)
+				}
+				mutex.Unlock()
+				return
+			}
+			usage.add(repo, blobs)
+		}(repo)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return sharingReport{}, firstErr
+	}
+	return buildSharingReport(plan, usage, top), nil
+}
+
+func buildSharingReport(plan *removalPlan, usage *blobUsage, top int) sharingReport {
+	report := sharingReport{}
+
+	freed := make(map[digest.Digest]int64)
+	for repo, blobs := range plan.blobs {
+		for blob, size := range blobs {
+			if len(usage.repos[blob]) == 0 {
+				freed[blob] = size
+			}
+			// removed blobs still count as shared by the repositories using them
+			if usage.repos[blob] == nil {
+				usage.repos[blob] = make(map[string]bool)
+			}
+			usage.repos[blob][repo] = true
+			usage.sizes[blob] = size
+		}
+	}
+	for _, size := range freed {
+		report.Freed += size
+	}
+
+	for blob, repos := range usage.repos {
+		if len(repos) < 2 {
+			continue
+		}
+		shared := sharedBlob{Digest: blob, Size: usage.sizes[blob]}
+		for repo := range repos {
+			shared.Repositories = append(shared.Repositories, repo)
+		}
+		sort.Strings(shared.Repositories)
+		report.Shared = append(report.Shared, shared)
+	}
+	sort.Slice(report.Shared, func(i, j int) bool {
+		a, b := report.Shared[i], report.Shared[j]
+		if len(a.Repositories) != len(b.Repositories) {
+			return len(a.Repositories) > len(b.Repositories)
+		}
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.Digest < b.Digest
+	})
+	if len(report.Shared) > top {
+		report.Shared = report.Shared[:top]
+	}
+	return report
+}
+
+func printSharingReport(report sharingReport) {
+	fmt.Println("Space freed in the whole registry: ", formatBytes(report.Freed))
+	fmt.Println("Most shared blobs:")
+	for _, blob := range report.Shared {
+		fmt.Printf("  %s %s %d repositories %v\n", blob.Digest, formatBytes(blob.Size), len(blob.Repositories), blob.Repositories)
+	}
+}
@@ -0,0 +1,43 @@
+// docker-unregstriy-untagger :- tests for the blob sharing analysis
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzeSharing(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	manifest := func(config, layer string) []byte {
+		return []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `",` +
+			`"config":{"digest":"` + config + `","size":1},` +
+			`"layers":[{"digest":"sha256:base","size":1000},{"digest":"` + layer + `","size":100}]}`)
+	}
+	old := f.addManifest("app", mediaTypeOCIManifest, manifest("sha256:c1", "sha256:l1"), "build_1")
+	f.addManifest("app", mediaTypeOCIManifest, manifest("sha256:c2", "sha256:l2"), "build_2")
+	f.addManifest("other", mediaTypeOCIManifest, manifest("sha256:c3", "sha256:l1"), "latest")
+	f.addManifest("third", mediaTypeOCIManifest, manifest("sha256:c4", "sha256:l4"), "latest")
+
+	plan := newRemovalPlan()
+	assert.NoError(t, plan.add(context.Background(), &registryBackend{}, "app", []digest.Digest{old}))
+
+	report, err := analyzeSharing(context.Background(), &registryBackend{}, plan, 2)
+	assert.NoError(t, err)
+	// sha256:l1 is still used by other, only the config is freed
+	assert.Equal(t, int64(1), report.Freed)
+	assert.Equal(t, []sharedBlob{
+		{Digest: "sha256:base", Size: 1000, Repositories: []string{"app", "other", "third"}},
+		{Digest: "sha256:l1", Size: 100, Repositories: []string{"app", "other"}},
+	}, report.Shared)
+}
@@ -0,0 +1,53 @@
+// docker-unregstriy-untagger :- graceful shutdown
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+var errInterrupted = errors.New("interrupted by shutdown")
+
+// shutdownContexts returns two contexts for SIGINT and SIGTERM, see watchSignals
+func shutdownContexts(timeout time.Duration) (context.Context, context.Context) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	return watchSignals(signals, timeout)
+}
+
+// watchSignals returns a context that is done with the first signal, from
+// then on nothing new is started, and a context for requests that is done
+// timeout later, so in-flight deletes can finish. A second signal cancels the
+// requests right away.
+func watchSignals(signals <-chan os.Signal, timeout time.Duration) (context.Context, context.Context) {
+	stopping, stop := context.WithCancel(context.Background())
+	requests, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		sig := <-signals
+		log.Printf("received %s, waiting up to %s for running requests", sig, timeout)
+		stop()
+
+		select {
+		case sig = <-signals:
+			log.Printf("received %s, cancelling running requests", sig)
+		case <-time.After(timeout):
+			log.Printf("shutdown timeout reached, cancelling running requests")
+		}
+		cancel()
+	}()
+
+	return stopping, requests
+}
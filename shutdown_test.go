@@ -0,0 +1,48 @@
+// docker-unregstriy-untagger :- tests for the graceful shutdown
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchSignals(t *testing.T) {
+	signals := make(chan os.Signal, 2)
+	stopping, requests := watchSignals(signals, 50*time.Millisecond)
+	assert.NoError(t, stopping.Err())
+	assert.NoError(t, requests.Err())
+
+	signals <- syscall.SIGTERM
+	<-stopping.Done()
+	assert.NoError(t, requests.Err())
+
+	select {
+	case <-requests.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("requests were not cancelled after the shutdown timeout")
+	}
+}
+
+func TestWatchSignalsTwice(t *testing.T) {
+	signals := make(chan os.Signal, 2)
+	stopping, requests := watchSignals(signals, time.Hour)
+
+	signals <- syscall.SIGINT
+	signals <- syscall.SIGINT
+	<-stopping.Done()
+
+	select {
+	case <-requests.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("requests were not cancelled by the second signal")
+	}
+}
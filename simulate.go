@@ -0,0 +1,314 @@
+// docker-unregstriy-untagger :- simulate the rules against a tag list
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// formats of a tag list
+const (
+	tagListPlain = "plain"
+	tagListCSV   = "csv"
+	tagListJSON  = "json"
+)
+
+// tagListEntry is a tag of a JSON tag list
+type tagListEntry struct {
+	Tag     string `json:"tag"`
+	Created string `json:"created"`
+	Digest  string `json:"digest"`
+}
+
+// tagListFormat guesses the format of a tag list from the file name or the
+// first character of its content
+func tagListFormat(fileName string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return tagListJSON
+	case ".csv":
+		return tagListCSV
+	case ".txt":
+		return tagListPlain
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return tagListJSON
+	case bytes.Contains(trimmed, []byte(",")):
+		return tagListCSV
+	default:
+		return tagListPlain
+	}
+}
+
+// parseCreated accepts RFC 3339 times and dates
+func parseCreated(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// newTagListInfo builds the tag of a list, a tag without digest gets one of
+// its own so it shares nothing with other tags
+func newTagListInfo(tag, created, dgst string) (tagInfo, error) {
+	info := tagInfo{Name: tag}
+	if tag == "" {
+		return info, fmt.Errorf("empty tag")
+	}
+
+	var err error
+	info.Created, err = parseCreated(created)
+	if err != nil {
+		return info, fmt.Errorf("created of %s: %s", tag, err)
+	}
+
+	info.Digest = digest.FromString("untagger-simulated-" + tag)
+	if dgst != "" {
+		info.Digest, err = digest.Parse(dgst)
+		if err != nil {
+			return info, fmt.Errorf("digest of %s: %s", tag, err)
+		}
+	}
+	return info, nil
+}
+
+// readTagList reads a tag list in the given format: one tag per line, CSV
+// with the columns tag, created and digest and an optional header, or a JSON
+// array of tags or of objects with tag, created and digest
+func readTagList(content []byte, format string) ([]tagInfo, error) {
+	var err error
+	infos := make([]tagInfo, 0)
+	add := func(tag, created, dgst string) error {
+		info, err := newTagListInfo(strings.TrimSpace(tag), strings.TrimSpace(created), strings.TrimSpace(dgst))
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+		return nil
+	}
+
+	switch format {
+	case tagListPlain:
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := add(line, "", ""); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case tagListCSV:
+		r := csv.NewReader(bytes.NewReader(content))
+		r.FieldsPerRecord = -1
+		r.Comment = '#'
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if i == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "tag") {
+				continue
+			}
+			if len(record) > 3 {
+				return nil, fmt.Errorf("line %d has %d columns, expected tag, created and digest", i+1, len(record))
+			}
+			record = append(record, "", "")
+			if err := add(record[0], record[1], record[2]); err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+		}
+	case tagListJSON:
+		items := make([]json.RawMessage, 0)
+		if err := json.Unmarshal(content, &items); err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			entry := tagListEntry{}
+			if bytes.HasPrefix(bytes.TrimSpace(item), []byte(`"`)) {
+				err = json.Unmarshal(item, &entry.Tag)
+			} else {
+				err = json.Unmarshal(item, &entry)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("entry %d: %s", i+1, err)
+			}
+			if err := add(entry.Tag, entry.Created, entry.Digest); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown tag list format %s, use %s, %s or %s", format, tagListPlain, tagListCSV, tagListJSON)
+	}
+
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		if seen[info.Name] {
+			return nil, fmt.Errorf("tag %s is listed twice", info.Name)
+		}
+		seen[info.Name] = true
+	}
+	return infos, nil
+}
+
+// tagListBackend serves a tag list as a single repository and never removes
+// anything
+type tagListBackend struct {
+	repo      string
+	tags      map[string]tagInfo
+	tagDelete bool
+}
+
+func newTagListBackend(repo string, infos []tagInfo, tagDelete bool) *tagListBackend {
+	b := &tagListBackend{repo: repo, tags: make(map[string]tagInfo), tagDelete: tagDelete}
+	for _, info := range infos {
+		b.tags[info.Name] = info
+	}
+	return b
+}
+
+func (t *tagListBackend) Repositories(ctx context.Context) ([]string, error) {
+	return []string{t.repo}, nil
+}
+
+func (t *tagListBackend) Tags(ctx context.Context, repo string) ([]tagInfo, error) {
+	infos := make([]tagInfo, 0, len(t.tags))
+	for _, info := range t.tags {
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (t *tagListBackend) lookup(tag string) (tagInfo, error) {
+	info, ok := t.tags[tag]
+	if !ok {
+		return info, fmt.Errorf("tag %s is not listed", tag)
+	}
+	return info, nil
+}
+
+func (t *tagListBackend) Digest(ctx context.Context, repo, tag string) (digest.Digest, error) {
+	info, err := t.lookup(tag)
+	return info.Digest, err
+}
+
+func (t *tagListBackend) Metadata(ctx context.Context, repo, tag string) (imageMetadata, error) {
+	info, err := t.lookup(tag)
+	return imageMetadata{Created: info.Created}, err
+}
+
+func (t *tagListBackend) DeleteTag(ctx context.Context, repo, tag string, dgst digest.Digest) error {
+	return fmt.Errorf("the simulation removes nothing")
+}
+
+func (t *tagListBackend) DeleteDigest(ctx context.Context, repo string, dgst digest.Digest) error {
+	return fmt.Errorf("the simulation removes nothing")
+}
+
+func (t *tagListBackend) Referrers(ctx context.Context, repo string, dgst digest.Digest) ([]digest.Digest, error) {
+	return nil, nil
+}
+
+func (t *tagListBackend) Manifest(ctx context.Context, repo string, dgst digest.Digest) ([]byte, string, error) {
+	return nil, "", fmt.Errorf("a tag list has no manifests")
+}
+
+func (t *tagListBackend) Blob(ctx context.Context, repo string, dgst digest.Digest) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("a tag list has no blobs")
+}
+
+func (t *tagListBackend) Capabilities() capabilities {
+	return capabilities{TagDelete: t.tagDelete, PushTime: true}
+}
+
+// formatDecisions prints one tag per line, the format of golden files
+func formatDecisions(decisions []tagDecision) []byte {
+	var buf bytes.Buffer
+	for _, d := range decisions {
+		fmt.Fprintf(&buf, "%s\t%s\t%s\n", d.Tag, d.action(), d.Reason)
+	}
+	return buf.Bytes()
+}
+
+// diffDecisions compares the lines of a golden file with the current
+// decisions. Lines only in the golden file start with -, new lines with +.
+func diffDecisions(golden, current []byte) []string {
+	split := func(b []byte) map[string]bool {
+		lines := make(map[string]bool)
+		for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+			if line != "" {
+				lines[line] = true
+			}
+		}
+		return lines
+	}
+	old, cur := split(golden), split(current)
+
+	diff := make([]string, 0)
+	for line := range old {
+		if !cur[line] {
+			diff = append(diff, "-"+line)
+		}
+	}
+	for line := range cur {
+		if !old[line] {
+			diff = append(diff, "+"+line)
+		}
+	}
+	// lines of the same tag next to each other, the old one first
+	tagOf := func(line string) string { return strings.SplitN(line[1:], "\t", 2)[0] }
+	sort.Slice(diff, func(i, j int) bool {
+		if ti, tj := tagOf(diff[i]), tagOf(diff[j]); ti != tj {
+			return ti < tj
+		}
+		if diff[i][0] != diff[j][0] {
+			return diff[i][0] == '-'
+		}
+		return diff[i] < diff[j]
+	})
+	return diff
+}
+
+// simulate evaluates the rules for a tag list at now
+func simulate(content []byte, format, repo string, tagDelete bool, now time.Time) ([]tagDecision, error) {
+	infos, err := readTagList(content, format)
+	if err != nil {
+		return nil, err
+	}
+	return explainRepository(context.Background(), newTagListBackend(repo, infos, tagDelete), repo, now)
+}
+
+// readInput reads a file or stdin for -
+func readInput(fileName string, stdin io.Reader) ([]byte, error) {
+	if fileName == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(fileName)
+}
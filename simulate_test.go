@@ -0,0 +1,120 @@
+// docker-unregstriy-untagger :- tests for the simulation
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadTagList(t *testing.T) {
+	created := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	shared := digest.FromString("shared")
+
+	var tests = []struct {
+		fileName string
+		content  string
+		tags     []tagInfo
+		err      bool
+	}{
+		{"tags.txt", "build_1\n# comment\n\nbuild_2\n", []tagInfo{{Name: "build_1"}, {Name: "build_2"}}, false},
+		{"-", "tag,created,digest\nbuild_1,2017-03-01T12:00:00Z," + shared.String() + "\nbuild_2,2017-03-01\n", []tagInfo{{Name: "build_1", Created: created, Digest: shared}, {Name: "build_2", Created: created.Add(-12 * time.Hour)}}, false},
+		{"-", `[{"tag":"build_1","created":"2017-03-01T12:00:00Z","digest":"` + shared.String() + `"},{"tag":"build_2"}]`, []tagInfo{{Name: "build_1", Created: created, Digest: shared}, {Name: "build_2"}}, false},
+		{"tags.json", `["build_1","build_2"]`, []tagInfo{{Name: "build_1"}, {Name: "build_2"}}, false},
+		{"-", "build_1\nbuild_1\n", nil, true},
+		{"-", "build_1,yesterday\n", nil, true},
+		{"tags.csv", "build_1,2017-03-01,sha256:nope\n", nil, true},
+	}
+
+	for i, tt := range tests {
+		infos, err := readTagList([]byte(tt.content), tagListFormat(tt.fileName, []byte(tt.content)))
+		if tt.err {
+			assert.Error(t, err, "TestReadTagList "+strconv.Itoa(i+1)+" should fail")
+			continue
+		}
+		assert.NoError(t, err)
+		// tags without digest get one of their own
+		for j := range tt.tags {
+			if tt.tags[j].Digest == "" {
+				tt.tags[j].Digest = digest.FromString("untagger-simulated-" + tt.tags[j].Name)
+			}
+		}
+		assert.Equal(t, tt.tags, infos, "TestReadTagList "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestDiffDecisions(t *testing.T) {
+	golden := []byte("build_1\tremove\told\nbuild_2\tkeep\tnew\nrelease_1\tkeep\tvalid\n")
+	current := []byte("build_1\tremove\told\nbuild_2\tremove\tnewer\nbuild_3\tkeep\tnew\nrelease_1\tkeep\tvalid\n")
+
+	assert.Equal(t, []string{"-build_2\tkeep\tnew", "+build_2\tremove\tnewer", "+build_3\tkeep\tnew"}, diffDecisions(golden, current))
+	assert.Empty(t, diffDecisions(golden, golden))
+}
+
+func TestSimulateCommand(t *testing.T) {
+	oldRules := rules
+	defer func() { rules = oldRules }()
+
+	dir, err := ioutil.TempDir("", "simulate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rulesFile := filepath.Join(dir, "rules.yml")
+	tagsFile := filepath.Join(dir, "tags.csv")
+	goldenFile := filepath.Join(dir, "golden.txt")
+	assert.NoError(t, ioutil.WriteFile(rulesFile, []byte("repositories: [app]\nvalidTags: ['^build_[0-9]+$', '^release_[0-9]+$']\nkeepBuilds: 1\nbuildSortRegex: build_([0-9]+)\nminAgeBeforeDelete: 7\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(tagsFile, []byte("build_1,2017-01-01\nbuild_2,2017-01-01\nbuild_3,2017-02-27\nbuild_4,2017-02-28\nlatest,2017-01-01\n"), 0644))
+
+	simulateArgs := []string{"-rules", rulesFile, "-now", "2017-03-01T00:00:00Z", "-golden", goldenFile}
+	assert.Equal(t, exitSuccess, runCommand(append(append([]string{"simulate"}, simulateArgs...), "-update", tagsFile)))
+	b, err := ioutil.ReadFile(goldenFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "build_1\tremove\tnot one of the newest 1 builds of flavor default\n"+
+		"build_2\tremove\tnot one of the newest 1 builds of flavor default\n"+
+		"build_3\tkeep\tnot one of the newest 1 builds of flavor default, but younger than 7 days (created 2017-02-27T00:00:00Z)\n"+
+		"build_4\tkeep\tone of the newest 1 builds of flavor default\n"+
+		"latest\tremove\tmatches none of validTags\n", string(b))
+
+	assert.Equal(t, exitSuccess, runCommand(append(append([]string{"simulate"}, simulateArgs...), tagsFile)))
+
+	// a rule change shows up as difference
+	assert.NoError(t, ioutil.WriteFile(rulesFile, []byte("repositories: [app]\nvalidTags: ['^build_[0-9]+$', '^latest$']\nkeepBuilds: 2\nbuildSortRegex: build_([0-9]+)\nminAgeBeforeDelete: 7\n"), 0644))
+	assert.Equal(t, exitPartialFailure, runCommand(append(append([]string{"simulate"}, simulateArgs...), tagsFile)))
+
+	assert.Equal(t, exitUsage, runCommand([]string{"simulate", "-update", tagsFile}))
+}
+
+func TestSimulateCommandWithoutConfig(t *testing.T) {
+	// simulate loads no config, nothing may depend on the globals of a run
+	defer use(targets[0])
+	pool, downloads = nil, nil
+
+	dir, err := ioutil.TempDir("", "simulate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rulesFile := filepath.Join(dir, "rules.yml")
+	tagsFile := filepath.Join(dir, "tags.txt")
+	assert.NoError(t, ioutil.WriteFile(rulesFile, []byte("repositories: [app]\nvalidTags: ['^build_[0-9]+$']\nkeepBuilds: 1\nbuildSortRegex: build_([0-9]+)\nminAgeBeforeDelete: 7\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(tagsFile, []byte("build_1\nbuild_2\nlatest\n"), 0644))
+
+	done := make(chan int)
+	go func() { done <- runCommand([]string{"simulate", "-rules", rulesFile, tagsFile}) }()
+	select {
+	case code := <-done:
+		assert.Equal(t, exitSuccess, code)
+	case <-time.After(10 * time.Second):
+		t.Fatal("simulate does not finish")
+	}
+}
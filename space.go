@@ -0,0 +1,161 @@
+// docker-unregstriy-untagger :- reclaimable space estimation
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// referencedBlobs returns the config and layer blobs with their sizes that
+// are referenced by the manifests, the children of an index included
+func referencedBlobs(ctx context.Context, b backend, repo string, manifests []digest.Digest) (map[digest.Digest]int64, error) {
+	blobs := make(map[digest.Digest]int64)
+	seen := make(map[digest.Digest]bool)
+	var firstErr error
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+
+	var visit func(dgst digest.Digest)
+	visit = func(dgst digest.Digest) {
+		defer wg.Done()
+
+		mutex.Lock()
+		if seen[dgst] || firstErr != nil {
+			mutex.Unlock()
+			return
+		}
+		seen[dgst] = true
+		mutex.Unlock()
+
+		downloads <- true
+		payload, mediaType, err := b.Manifest(ctx, repo, dgst)
+		<-downloads
+		var m imageManifest
+		if err == nil {
+			m, err = parseManifest(mediaType, payload)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("manifest %s: %s", dgst, err)
+			}
+			return
+		}
+		for _, blob := range m.blobs() {
+			blobs[blob.Digest] = blob.Size
+		}
+		for _, child := range m.Manifests {
+			wg.Add(1)
+			go visit(child.Digest)
+		}
+	}
+
+	for _, dgst := range manifests {
+		wg.Add(1)
+		go visit(dgst)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return blobs, nil
+}
+
+// exclusiveSize sums the sizes of all blobs in removed that are not in kept
+func exclusiveSize(removed, kept map[digest.Digest]int64) int64 {
+	size := int64(0)
+	for blob, blobSize := range removed {
+		if _, ok := kept[blob]; !ok {
+			size += blobSize
+		}
+	}
+	return size
+}
+
+// reclaimableSize estimates how many bytes the garbage-collector frees in
+// repo if the removed manifests are deleted and the kept ones stay. Blobs
+// shared with other repositories are counted as well.
+func reclaimableSize(ctx context.Context, b backend, repo string, removed, kept []digest.Digest) (int64, error) {
+	if len(removed) == 0 {
+		return 0, nil
+	}
+
+	removedBlobs, err := referencedBlobs(ctx, b, repo, removed)
+	if err != nil {
+		return 0, err
+	}
+	keptBlobs, err := referencedBlobs(ctx, b, repo, kept)
+	if err != nil {
+		return 0, err
+	}
+	return exclusiveSize(removedBlobs, keptBlobs), nil
+}
+
+// splitDigests returns the unique digests that will be removed and those that
+// stay: the digests of kept tags and candidates that are still in quarantine
+func splitDigests(digestToSave []string, candidates, removed []digest.Digest) ([]digest.Digest, []digest.Digest) {
+	removedSet := make(map[digest.Digest]bool)
+	removedDigests := make([]digest.Digest, 0)
+	for _, d := range removed {
+		if !removedSet[d] {
+			removedSet[d] = true
+			removedDigests = append(removedDigests, d)
+		}
+	}
+
+	keptSet := make(map[digest.Digest]bool)
+	keptDigests := make([]digest.Digest, 0)
+	keep := func(d digest.Digest) {
+		if !keptSet[d] && !removedSet[d] {
+			keptSet[d] = true
+			keptDigests = append(keptDigests, d)
+		}
+	}
+	for _, d := range digestToSave {
+		keep(digest.Digest(d))
+	}
+	for _, d := range candidates {
+		keep(d)
+	}
+	return removedDigests, keptDigests
+}
+
+// notInDigests returns the digests that are not in keep
+func notInDigests(digests []digest.Digest, keep []string) []digest.Digest {
+	if !sort.StringsAreSorted(keep) {
+		sort.Strings(keep)
+	}
+	ret := make([]digest.Digest, 0)
+	for _, d := range digests {
+		if !contains(keep, d.String()) {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// formatBytes prints a size in the largest fitting binary unit
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,78 @@
+// docker-unregstriy-untagger :- tests for reclaimable space estimation
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExclusiveSize(t *testing.T) {
+	removed := map[digest.Digest]int64{"sha256:01": 10, "sha256:02": 20, "sha256:03": 30}
+	kept := map[digest.Digest]int64{"sha256:02": 20, "sha256:04": 40}
+	assert.Equal(t, int64(40), exclusiveSize(removed, kept))
+	assert.Equal(t, int64(0), exclusiveSize(map[digest.Digest]int64{}, kept))
+}
+
+func TestSplitDigests(t *testing.T) {
+	removed, kept := splitDigests(
+		[]string{"sha256:01", "sha256:02"},
+		[]digest.Digest{"sha256:03", "sha256:03", "sha256:04"},
+		[]digest.Digest{"sha256:03", "sha256:03"},
+	)
+	assert.Equal(t, []digest.Digest{"sha256:03"}, removed)
+	assert.Equal(t, []digest.Digest{"sha256:01", "sha256:02", "sha256:04"}, kept)
+}
+
+func TestFormatBytes(t *testing.T) {
+	var tests = []struct {
+		in  int64
+		out string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024 * 1024, "5.0 GiB"},
+	}
+	for _, tt := range tests {
+		if b := formatBytes(tt.in); b != tt.out {
+			t.Errorf("formatBytes(%d) => %q, want %q", tt.in, b, tt.out)
+		}
+	}
+}
+
+func TestReclaimableSize(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	manifest := func(config, layer string, layerSize string) []byte {
+		return []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `",` +
+			`"config":{"digest":"` + config + `","size":1},` +
+			`"layers":[{"digest":"sha256:base","size":1000},{"digest":"` + layer + `","size":` + layerSize + `}]}`)
+	}
+	old := f.addManifest("app", mediaTypeOCIManifest, manifest("sha256:c1", "sha256:l1", "100"), "build_1")
+	kept := f.addManifest("app", mediaTypeOCIManifest, manifest("sha256:c2", "sha256:l2", "200"), "build_2")
+	index := []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIIndex + `","manifests":[{"digest":"` + old.String() + `"}]}`)
+	multi := f.addManifest("app", mediaTypeOCIIndex, index, "multi_1")
+
+	size, err := reclaimableSize(context.Background(), &registryBackend{}, "app", []digest.Digest{old}, []digest.Digest{kept})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(101), size)
+
+	// the index keeps all blobs of its child
+	size, err = reclaimableSize(context.Background(), &registryBackend{}, "app", []digest.Digest{old}, []digest.Digest{kept, multi})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	_, err = reclaimableSize(context.Background(), &registryBackend{}, "app", []digest.Digest{digest.FromString("missing")}, []digest.Digest{kept})
+	assert.Error(t, err)
+}
@@ -0,0 +1,230 @@
+// docker-unregstriy-untagger :- repository statistics
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// expiryDays are the periods stats counts the expiring tags for
+var expiryDays = []int{7, 30, 90}
+
+// thresholds of the hints for repositories worth attention
+const (
+	statsManyTags  = 100
+	statsLargeSize = 10 << 30
+)
+
+// buildStats is the oldest or newest build of a repository
+type buildStats struct {
+	Tag     string    `json:"tag"`
+	Created time.Time `json:"created"`
+}
+
+// repositoryStats describes a repository and what the rules do with it
+type repositoryStats struct {
+	Repository string         `json:"repository"`
+	Configured bool           `json:"configured"`
+	Tags       int            `json:"tags"`
+	Flavors    map[string]int `json:"flavors"`
+	Invalid    int            `json:"invalid"`
+	Removed    int            `json:"removed"`
+	Oldest     *buildStats    `json:"oldestBuild,omitempty"`
+	Newest     *buildStats    `json:"newestBuild,omitempty"`
+	Digests    int            `json:"digests"`
+	// the sizes are missing for backends without manifests like gitlab
+	TotalSize  *int64         `json:"totalSize,omitempty"`
+	UniqueSize *int64         `json:"uniqueSize,omitempty"`
+	Expiring   map[string]int `json:"expiring"`
+	Attention  []string       `json:"attention,omitempty"`
+}
+
+// collectStats reads the tags of repo once and evaluates the rules now and
+// at the end of every expiry period
+func collectStats(ctx context.Context, b backend, repo string, configured bool, now time.Time) (repositoryStats, error) {
+	s := repositoryStats{Repository: repo, Configured: configured, Flavors: make(map[string]int), Expiring: make(map[string]int)}
+
+	infos, err := b.Tags(ctx, repo)
+	if err != nil {
+		return s, err
+	}
+	tagDelete := b.Capabilities().TagDelete
+	listed := newListedTags(b, infos)
+
+	// the details of every tag are looked up once in parallel, the
+	// evaluations below only work on the list
+	names := tagNames(infos)
+	tagDigests, err := digestOfTags(ctx, listed, repo, names)
+	if err != nil {
+		return s, err
+	}
+	created, err := createdOfTags(ctx, listed, repo, names)
+	if err != nil {
+		return s, err
+	}
+	digests := make(map[digest.Digest]bool)
+	for i, info := range infos {
+		infos[i].Digest, infos[i].Created = tagDigests[info.Name], created[info.Name]
+		digests[infos[i].Digest] = true
+	}
+	s.Tags, s.Digests = len(infos), len(digests)
+
+	ruleTags, _ := splitSubjectTags(names)
+	s.Invalid = len(getInvalidTags(rules.ValidTagsRegex, ruleTags))
+	for flavor, builds := range getFlavor(rules.SortAndFilterRegex, ruleTags) {
+		s.Flavors[flavor] = len(builds)
+		for _, build := range builds {
+			candidate := &buildStats{Tag: build.name, Created: created[build.name]}
+			if s.Oldest == nil || candidate.Created.Before(s.Oldest.Created) {
+				s.Oldest = candidate
+			}
+			if s.Newest == nil || candidate.Created.After(s.Newest.Created) {
+				s.Newest = candidate
+			}
+		}
+	}
+
+	simulated := newTagListBackend(repo, infos, tagDelete)
+	decisions, err := explainRepository(ctx, simulated, repo, now)
+	if err != nil {
+		return s, err
+	}
+	s.Removed = countDecisions(decisions).Removed
+	for _, days := range expiryDays {
+		later, err := explainRepository(ctx, simulated, repo, now.Add(time.Duration(days)*24*time.Hour))
+		if err != nil {
+			return s, err
+		}
+		s.Expiring[strconv.Itoa(days)] = countDecisions(later).Removed - s.Removed
+	}
+
+	if b.Capabilities().Manifests {
+		if err := s.addSizes(ctx, b, digests); err != nil {
+			return s, err
+		}
+	}
+	s.Attention = attention(s)
+	return s, nil
+}
+
+// addSizes sums the blobs of every digest for the total size and every blob
+// once for the unique size
+func (s *repositoryStats) addSizes(ctx context.Context, b backend, digests map[digest.Digest]bool) error {
+	total, unique := int64(0), int64(0)
+	all := make(map[digest.Digest]int64)
+	for dgst := range digests {
+		blobs, err := referencedBlobs(ctx, b, s.Repository, []digest.Digest{dgst})
+		if err != nil {
+			return err
+		}
+		for blob, size := range blobs {
+			total += size
+			all[blob] = size
+		}
+	}
+	for _, size := range all {
+		unique += size
+	}
+	s.TotalSize, s.UniqueSize = &total, &unique
+	return nil
+}
+
+// attention returns why a repository is worth a look before writing rules
+func attention(s repositoryStats) []string {
+	hints := make([]string, 0)
+	if !s.Configured {
+		hints = append(hints, "not in rules")
+	}
+	if s.Tags >= statsManyTags {
+		hints = append(hints, "many tags")
+	}
+	if s.Tags != 0 && s.Invalid*2 > s.Tags {
+		hints = append(hints, "mostly invalid tags")
+	}
+	if s.UniqueSize != nil && *s.UniqueSize >= statsLargeSize {
+		hints = append(hints, "large")
+	}
+	return hints
+}
+
+// statsRepositories returns the repositories stats looks at: the arguments,
+// all repositories of the registry or the repositories of the rules
+func statsRepositories(ctx context.Context, b backend, args []string, all bool) ([]string, map[string]bool, error) {
+	configured := make(map[string]bool)
+	for _, repo := range rules.Repositories {
+		configured[repo] = true
+	}
+	if len(args) != 0 || !all {
+		return repositories(args), configured, nil
+	}
+
+	repos, err := b.Repositories(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(repos)
+	return repos, configured, nil
+}
+
+func formatOptionalBytes(size *int64) string {
+	if size == nil {
+		return "-"
+	}
+	return formatBytes(*size)
+}
+
+func formatBuild(b *buildStats) string {
+	if b == nil {
+		return "-"
+	}
+	return b.Tag + " (" + b.Created.Format("2006-01-02") + ")"
+}
+
+func printStatsTable(w io.Writer, stats []repositoryStats) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	header := "REPOSITORY\tTAGS\tFLAVORS\tINVALID\tREMOVED\tOLDEST BUILD\tNEWEST BUILD\tDIGESTS\tTOTAL\tUNIQUE"
+	for _, days := range expiryDays {
+		header += "\t" + strconv.Itoa(days) + "D"
+	}
+	fmt.Fprintln(tw, header+"\tATTENTION")
+
+	for _, s := range stats {
+		names := make([]string, 0, len(s.Flavors))
+		for flavor := range s.Flavors {
+			names = append(names, flavor)
+		}
+		sort.Strings(names)
+		flavors := make([]string, 0, len(names))
+		for _, flavor := range names {
+			flavors = append(flavors, flavor+":"+strconv.Itoa(s.Flavors[flavor]))
+		}
+		if len(flavors) == 0 {
+			flavors = append(flavors, "-")
+		}
+
+		line := fmt.Sprintf("%s\t%d\t%s\t%d\t%d\t%s\t%s\t%d\t%s\t%s", s.Repository, s.Tags, strings.Join(flavors, ","), s.Invalid, s.Removed,
+			formatBuild(s.Oldest), formatBuild(s.Newest), s.Digests, formatOptionalBytes(s.TotalSize), formatOptionalBytes(s.UniqueSize))
+		for _, days := range expiryDays {
+			line += "\t" + strconv.Itoa(s.Expiring[strconv.Itoa(days)])
+		}
+		attention := strings.Join(s.Attention, ", ")
+		if attention == "" {
+			attention = "-"
+		}
+		fmt.Fprintln(tw, line+"\t"+attention)
+	}
+	tw.Flush()
+}
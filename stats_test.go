@@ -0,0 +1,138 @@
+// docker-unregstriy-untagger :- tests for stats
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectStats(t *testing.T) {
+	oldRules := rules
+	defer func() { rules = oldRules }()
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("^(centos_)?build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("^(?P<flavor>centos_)?build_(?P<buildnr>[0-9]+)$"),
+		KeepNewestBySort:   1,
+		MinAge:             30,
+	}
+
+	now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	b := newMemoryBackend(false, true)
+	first := b.addImage("app", "build_1", now.Add(-100*day), "base", "l1")
+	b.addImage("app", "build_2", now.Add(-25*day), "base", "l2")
+	b.addImage("app", "build_3", now.Add(-1*day), "base", "l3")
+	centos := b.addImage("app", "centos_build_1", now.Add(-80*day), "base", "c1")
+	b.add("app", "centos_build_2", centos, now.Add(-5*day))
+	b.add("app", "release_1", first, now.Add(-100*day))
+	b.addImage("app", "latest", now.Add(-10*day), "base", "latest")
+
+	s, err := collectStats(context.Background(), b, "app", true, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", s.Repository)
+	assert.Equal(t, 7, s.Tags)
+	assert.Equal(t, map[string]int{"": 3, "centos_": 2}, s.Flavors)
+	assert.Equal(t, 1, s.Invalid)
+	assert.Equal(t, 5, s.Digests)
+	assert.Equal(t, &buildStats{Tag: "build_1", Created: now.Add(-100 * day)}, s.Oldest)
+	assert.Equal(t, &buildStats{Tag: "build_3", Created: now.Add(-1 * day)}, s.Newest)
+	// build_1 shares its digest with release_1, centos_build_1 with the
+	// newest centos build, so nothing is removed yet
+	assert.Equal(t, 0, s.Removed)
+	// build_2 is old enough in 5 days, latest in 20 days
+	assert.Equal(t, map[string]int{"7": 1, "30": 2, "90": 2}, s.Expiring)
+	// every image has a config of 34 bytes and the base layer of 4 bytes,
+	// the base layer is counted once for the unique size
+	assert.Equal(t, int64(5*(34+4)+2+2+2+2+6), *s.TotalSize)
+	assert.Equal(t, int64(5*34+4+2+2+2+2+6), *s.UniqueSize)
+	assert.Equal(t, []string{}, s.Attention)
+
+	// a backend without manifests has no sizes
+	infos, err := b.Tags(context.Background(), "app")
+	assert.NoError(t, err)
+	s, err = collectStats(context.Background(), newTagListBackend("app", infos, false), "app", true, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, s.Tags)
+	assert.Nil(t, s.TotalSize)
+	assert.Nil(t, s.UniqueSize)
+
+	s, err = collectStats(context.Background(), b, "app", false, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"not in rules"}, s.Attention)
+
+	s, err = collectStats(context.Background(), b, "empty", true, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, s.Tags)
+	assert.Nil(t, s.Oldest)
+	assert.Equal(t, map[string]int{"7": 0, "30": 0, "90": 0}, s.Expiring)
+}
+
+func TestStatsSizes(t *testing.T) {
+	f := newFakeRegistry()
+	srv := startFakeRegistry(f)
+	defer srv.Close()
+
+	manifest := func(config, layer string, layerSize string) []byte {
+		return []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `",` +
+			`"config":{"digest":"` + config + `","size":1},` +
+			`"layers":[{"digest":"sha256:base","size":1000},{"digest":"` + layer + `","size":` + layerSize + `}]}`)
+	}
+	first := f.addManifest("app", mediaTypeOCIManifest, manifest("sha256:c1", "sha256:l1", "100"), "build_1")
+	second := f.addManifest("app", mediaTypeOCIManifest, manifest("sha256:c2", "sha256:l2", "200"), "build_2")
+
+	s := repositoryStats{Repository: "app"}
+	assert.NoError(t, s.addSizes(context.Background(), &registryBackend{}, map[digest.Digest]bool{first: true, second: true}))
+	assert.Equal(t, int64(2302), *s.TotalSize)
+	assert.Equal(t, int64(1302), *s.UniqueSize)
+
+	s = repositoryStats{Repository: "app"}
+	assert.Error(t, s.addSizes(context.Background(), &registryBackend{}, map[digest.Digest]bool{digest.FromString("missing"): true}))
+}
+
+func TestAttention(t *testing.T) {
+	small, large := int64(1<<20), int64(statsLargeSize)
+	var tests = []struct {
+		in  repositoryStats
+		out []string
+	}{
+		{repositoryStats{Configured: true, Tags: 10, Invalid: 2, UniqueSize: &small}, []string{}},
+		{repositoryStats{Configured: true}, []string{}},
+		{repositoryStats{Tags: 10}, []string{"not in rules"}},
+		{repositoryStats{Configured: true, Tags: 150, Invalid: 100}, []string{"many tags", "mostly invalid tags"}},
+		{repositoryStats{Configured: true, Tags: 4, Invalid: 2, UniqueSize: &large}, []string{"large"}},
+	}
+	for i, tt := range tests {
+		assert.Equal(t, tt.out, attention(tt.in), "TestAttention "+strconv.Itoa(i+1)+" values should be equal")
+	}
+}
+
+func TestPrintStatsTable(t *testing.T) {
+	size := int64(1536)
+	created := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	printStatsTable(&buf, []repositoryStats{
+		{Repository: "app", Configured: true, Tags: 3, Flavors: map[string]int{"centos_": 1, "": 2}, Digests: 2,
+			Oldest: &buildStats{Tag: "build_1", Created: created}, Newest: &buildStats{Tag: "build_2", Created: created},
+			TotalSize: &size, UniqueSize: &size, Expiring: map[string]int{"7": 1, "30": 2, "90": 3}, Attention: []string{}},
+		{Repository: "other", Tags: 1, Flavors: map[string]int{}, Expiring: map[string]int{}, Attention: []string{"not in rules"}},
+	})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, []string{"REPOSITORY", "TAGS", "FLAVORS", "INVALID", "REMOVED", "OLDEST", "BUILD", "NEWEST", "BUILD", "DIGESTS", "TOTAL", "UNIQUE", "7D", "30D", "90D", "ATTENTION"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"app", "3", ":2,centos_:1", "0", "0", "build_1", "(2017-05-01)", "build_2", "(2017-05-01)", "2", "1.5", "KiB", "1.5", "KiB", "1", "2", "3", "-"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"other", "1", "-", "0", "0", "-", "-", "0", "-", "-", "0", "0", "0", "not", "in", "rules"}, strings.Fields(lines[2]))
+}
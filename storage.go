@@ -0,0 +1,327 @@
+// docker-unregstriy-untagger :- read registry filesystem storage directly
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/opencontainers/go-digest"
+)
+
+// storage reads the layout of the distribution filesystem driver
+type storage struct {
+	root string
+}
+
+func newStorage(path string) *storage {
+	return &storage{root: filepath.Join(path, "docker", "registry", "v2")}
+}
+
+func (s *storage) repoPath(repo string, elem ...string) string {
+	return filepath.Join(append([]string{s.root, "repositories", filepath.FromSlash(repo)}, elem...)...)
+}
+
+func (s *storage) blobPath(dgst digest.Digest) string {
+	hex := dgst.Hex()
+	if len(hex) < 2 {
+		hex = "00"
+	}
+	return filepath.Join(s.root, "blobs", dgst.Algorithm().String(), hex[:2], dgst.Hex(), "data")
+}
+
+func readLink(fileName string) (digest.Digest, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	return digest.Parse(strings.TrimSpace(string(b)))
+}
+
+// repositories lists every directory that contains a _manifests directory
+func (s *storage) repositories() ([]string, error) {
+	base := filepath.Join(s.root, "repositories")
+	repos := make([]string, 0)
+	err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == "_manifests" {
+			repo, err := filepath.Rel(base, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			repos = append(repos, filepath.ToSlash(repo))
+			return filepath.SkipDir
+		}
+		if strings.HasPrefix(info.Name(), "_") {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(repos)
+	return repos, err
+}
+
+func (s *storage) tags(repo string) ([]string, error) {
+	infos, err := ioutil.ReadDir(s.repoPath(repo, "_manifests", "tags"))
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, 0)
+	for _, info := range infos {
+		if _, err := os.Stat(s.repoPath(repo, "_manifests", "tags", info.Name(), "current", "link")); err == nil {
+			tags = append(tags, info.Name())
+		}
+	}
+	return tags, nil
+}
+
+// resolve returns the digest of a tag or checks that a digest is a revision of repo
+func (s *storage) resolve(repo, reference string) (digest.Digest, error) {
+	dgst, err := digest.Parse(reference)
+	if err != nil {
+		return readLink(s.repoPath(repo, "_manifests", "tags", reference, "current", "link"))
+	}
+
+	if _, err := readLink(s.repoPath(repo, "_manifests", "revisions", dgst.Algorithm().String(), dgst.Hex(), "link")); err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
+
+func (s *storage) manifest(repo, reference string) ([]byte, string, digest.Digest, error) {
+	dgst, err := s.resolve(repo, reference)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	payload, err := ioutil.ReadFile(s.blobPath(dgst))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	m, err := parseManifest("", payload)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return payload, detectMediaType(m), dgst, nil
+}
+
+// detectMediaType guesses the type of manifests without a mediaType field
+func detectMediaType(m imageManifest) string {
+	switch {
+	case m.MediaType != "":
+		return m.MediaType
+	case m.Manifests != nil:
+		return mediaTypeOCIIndex
+	case m.Config != nil:
+		return mediaTypeOCIManifest
+	default:
+		return schema1.MediaTypeSignedManifest
+	}
+}
+
+// hasBlob checks that the blob is linked into repo
+func (s *storage) hasBlob(repo string, dgst digest.Digest) bool {
+	_, err := readLink(s.repoPath(repo, "_layers", dgst.Algorithm().String(), dgst.Hex(), "link"))
+	return err == nil
+}
+
+// revisionPath is the directory of the link that makes dgst a manifest of repo
+func (s *storage) revisionPath(repo string, dgst digest.Digest) string {
+	return s.repoPath(repo, "_manifests", "revisions", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// taggedWith returns all tags of repo that point to dgst
+func (s *storage) taggedWith(repo string, dgst digest.Digest) ([]string, error) {
+	tags, err := s.tags(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0)
+	for _, tag := range tags {
+		if d, err := s.resolve(repo, tag); err == nil && d == dgst {
+			ret = append(ret, tag)
+		}
+	}
+	return ret, nil
+}
+
+// untag removes a single tag like the registry does for a DELETE by tag. The
+// manifest revision stays, it may still be a child of a tagged index and is
+// left to the garbage-collector.
+func (s *storage) untag(repo, tag string) error {
+	if _, err := s.resolve(repo, tag); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.repoPath(repo, "_manifests", "tags", tag))
+}
+
+// deleteManifest removes a revision and all tags pointing to it, like the
+// registry does for a DELETE by digest
+func (s *storage) deleteManifest(repo string, dgst digest.Digest) error {
+	if _, err := s.resolve(repo, dgst.String()); err != nil {
+		return err
+	}
+
+	tags, err := s.taggedWith(repo, dgst)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := os.RemoveAll(s.repoPath(repo, "_manifests", "tags", tag)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.revisionPath(repo, dgst))
+}
+
+// storageTransport answers the registry API from filesystem storage, so the
+// rules can be evaluated without a registry. Besides reading only deleting
+// manifests and single tags is supported.
+type storageTransport struct {
+	storage *storage
+}
+
+func newResponse(req *http.Request, status int, header http.Header, body io.ReadCloser, length int64) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	if body == nil || req.Method == "HEAD" {
+		if body != nil {
+			body.Close()
+		}
+		body = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}
+}
+
+func jsonResponse(req *http.Request, v interface{}) (*http.Response, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	return newResponse(req, http.StatusOK, header, ioutil.NopCloser(bytes.NewReader(b)), int64(len(b))), nil
+}
+
+func (t *storageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+
+	if req.Method == "DELETE" && strings.Contains(path, "/manifests/") {
+		return t.delete(req, path)
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return newResponse(req, http.StatusMethodNotAllowed, nil, nil, 0), nil
+	}
+
+	switch {
+	case req.URL.Path == "/v2/":
+		return newResponse(req, http.StatusOK, nil, nil, 0), nil
+
+	case path == "_catalog":
+		repos, err := t.storage.repositories()
+		if err != nil {
+			return nil, err
+		}
+		return jsonResponse(req, map[string][]string{"repositories": repos})
+
+	case strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		tags, err := t.storage.tags(repo)
+		if os.IsNotExist(err) {
+			return newResponse(req, http.StatusNotFound, nil, nil, 0), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return jsonResponse(req, map[string]interface{}{"name": repo, "tags": tags})
+
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		payload, mediaType, dgst, err := t.storage.manifest(parts[0], parts[1])
+		if err != nil {
+			return newResponse(req, http.StatusNotFound, nil, nil, 0), nil
+		}
+		header := http.Header{
+			"Content-Type":          []string{mediaType},
+			"Docker-Content-Digest": []string{dgst.String()},
+		}
+		return newResponse(req, http.StatusOK, header, ioutil.NopCloser(bytes.NewReader(payload)), int64(len(payload))), nil
+
+	case strings.Contains(path, "/blobs/"):
+		parts := strings.SplitN(path, "/blobs/", 2)
+		dgst, err := digest.Parse(parts[1])
+		if err != nil || !t.storage.hasBlob(parts[0], dgst) {
+			return newResponse(req, http.StatusNotFound, nil, nil, 0), nil
+		}
+		f, err := os.Open(t.storage.blobPath(dgst))
+		if err != nil {
+			return newResponse(req, http.StatusNotFound, nil, nil, 0), nil
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		header := http.Header{
+			"Content-Type":          []string{"application/octet-stream"},
+			"Docker-Content-Digest": []string{dgst.String()},
+		}
+		return newResponse(req, http.StatusOK, header, f, info.Size()), nil
+	}
+
+	return newResponse(req, http.StatusNotFound, nil, nil, 0), nil
+}
+
+// delete removes a manifest by digest or a single tag
+func (t *storageTransport) delete(req *http.Request, path string) (*http.Response, error) {
+	parts := strings.SplitN(path, "/manifests/", 2)
+	repo, reference := parts[0], parts[1]
+
+	var err error
+	if dgst, parseErr := digest.Parse(reference); parseErr == nil {
+		err = t.storage.deleteManifest(repo, dgst)
+	} else {
+		err = t.storage.untag(repo, reference)
+	}
+	if os.IsNotExist(err) {
+		b := []byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+		header := http.Header{"Content-Type": []string{"application/json"}}
+		return newResponse(req, http.StatusNotFound, header, ioutil.NopCloser(bytes.NewReader(b)), int64(len(b))), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newResponse(req, http.StatusAccepted, nil, nil, 0), nil
+}
@@ -0,0 +1,165 @@
+// docker-unregstriy-untagger :- tests for reading filesystem storage
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStorage writes the layout of the distribution filesystem driver
+type fakeStorage struct {
+	t    *testing.T
+	path string
+	s    *storage
+}
+
+func newFakeStorage(t *testing.T) *fakeStorage {
+	path, err := ioutil.TempDir("", "untagger")
+	assert.NoError(t, err)
+	return &fakeStorage{t: t, path: path, s: newStorage(path)}
+}
+
+func (f *fakeStorage) write(fileName string, content []byte) {
+	assert.NoError(f.t, os.MkdirAll(filepath.Dir(fileName), 0755))
+	assert.NoError(f.t, ioutil.WriteFile(fileName, content, 0644))
+}
+
+func (f *fakeStorage) addBlob(repo string, content []byte) digest.Digest {
+	d := digest.FromBytes(content)
+	f.write(f.s.blobPath(d), content)
+	f.write(f.s.repoPath(repo, "_layers", "sha256", d.Hex(), "link"), []byte(d.String()))
+	return d
+}
+
+func (f *fakeStorage) addManifest(repo string, payload []byte, tags ...string) digest.Digest {
+	d := digest.FromBytes(payload)
+	f.write(f.s.blobPath(d), payload)
+	f.write(f.s.repoPath(repo, "_manifests", "revisions", "sha256", d.Hex(), "link"), []byte(d.String()))
+	for _, tag := range tags {
+		f.write(f.s.repoPath(repo, "_manifests", "tags", tag, "current", "link"), []byte(d.String()))
+		f.write(f.s.repoPath(repo, "_manifests", "tags", tag, "index", "sha256", d.Hex(), "link"), []byte(d.String()))
+	}
+	return d
+}
+
+func TestStorageTransport(t *testing.T) {
+	f := newFakeStorage(t)
+	defer os.RemoveAll(f.path)
+
+	config := f.addBlob("team/app", []byte(`{"created":"2017-03-01T00:00:00Z"}`))
+	payload := []byte(`{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `","config":{"digest":"` + config.String() + `","size":34}}`)
+	d := f.addManifest("team/app", payload, "build_1", "latest")
+	f.addManifest("other", []byte(`{"schemaVersion":1,"name":"other"}`), "v1")
+
+	oldHub, oldMetadata := hub, metadata
+	defer func() { hub, metadata = oldHub, oldMetadata }()
+	hub = connectStorage(f.path)
+	metadata = newMetadataCache(0)
+
+	repos, err := hub.Repositories()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other", "team/app"}, repos)
+
+	tags, err := hub.Tags("team/app")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build_1", "latest"}, tags)
+
+	dgst, err := hub.ManifestDigest("team/app", "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, d, dgst)
+
+	m, err := imageMetadataFor(context.Background(), "team/app", "build_1")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), m.Created)
+	assert.Equal(t, schema2.MediaTypeManifest, m.MediaType)
+
+	_, mediaType, err := getManifest(context.Background(), "other", "v1")
+	assert.NoError(t, err)
+	assert.Equal(t, schema1.MediaTypeSignedManifest, mediaType)
+
+	ok, err := hub.HasLayer("other", config)
+	assert.NoError(t, err)
+	assert.False(t, ok, "blob is not linked into other")
+
+	_, err = hub.ManifestDigest("team/app", "missing")
+	assert.True(t, isNotFound(err))
+
+	// deleting by digest removes all tags like the registry does
+	assert.NoError(t, hub.DeleteManifest("team/app", d))
+	tags, err = hub.Tags("team/app")
+	assert.NoError(t, err)
+	assert.Len(t, tags, 0)
+}
+
+func TestStorageUntag(t *testing.T) {
+	f := newFakeStorage(t)
+	defer os.RemoveAll(f.path)
+
+	shared := f.addManifest("app", []byte(`{"schemaVersion":1,"name":"shared"}`), "build_1", "release_1")
+	single := f.addManifest("app", []byte(`{"schemaVersion":1,"name":"single"}`), "build_2")
+
+	assert.NoError(t, f.s.untag("app", "build_1"))
+	tags, err := f.s.tags("app")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build_2", "release_1"}, tags)
+	_, err = f.s.resolve("app", shared.String())
+	assert.NoError(t, err)
+
+	// the revision stays for the garbage-collector, also without tags
+	assert.NoError(t, f.s.untag("app", "build_2"))
+	_, err = f.s.resolve("app", single.String())
+	assert.NoError(t, err)
+	_, err = f.s.resolve("app", "build_2")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.True(t, os.IsNotExist(f.s.untag("app", "missing")))
+}
+
+func TestCleanRepositoryUntag(t *testing.T) {
+	f := newFakeStorage(t)
+	defer os.RemoveAll(f.path)
+
+	oldHub, oldRules, oldDryRun := hub, rules, dryRun
+	defer func() { hub, rules, dryRun = oldHub, oldRules, oldDryRun }()
+	hub = connectStorage(f.path)
+	dryRun = false
+	rules = rule{
+		ValidTagsRegex:     []*regexp.Regexp{regexp.MustCompile("^release_[0-9]+$"), regexp.MustCompile("^build_[0-9]+$")},
+		SortAndFilterRegex: regexp.MustCompile("build_([0-9]+)"),
+		KeepNewestBySort:   1,
+	}
+
+	shared := f.addManifest("app", []byte(`{"schemaVersion":1,"name":"1"}`), "build_1", "release_1")
+	f.addManifest("app", []byte(`{"schemaVersion":1,"name":"2"}`), "build_2")
+
+	tagDelete, err := probeTagDeletion(context.Background(), "app")
+	assert.NoError(t, err)
+	assert.True(t, tagDelete, "filesystem storage removes single tags")
+
+	// build_1 goes although release_1 shares its digest
+	removed, _, err := cleanRepository(context.Background(), context.Background(), &registryBackend{tagDelete: tagDelete}, "app", &runSummary{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	tags, err := f.s.tags("app")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build_2", "release_1"}, tags)
+	d, err := f.s.resolve("app", "release_1")
+	assert.NoError(t, err)
+	assert.Equal(t, shared, d)
+}
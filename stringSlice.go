@@ -63,3 +63,35 @@ func notIn(a, b []string) []string {
 	}
 	return ret
 }
+
+// parallelFilterErr works like parallelFilter but f can fail, the first error
+// is returned instead of the filtered slice
+func parallelFilterErr(vs []string, f func(string) (bool, error)) ([]string, error) {
+	vsf := make([]string, 0)
+	var firstErr error
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+	for _, v := range vs {
+		wg.Add(1)
+		go func(v string) {
+			defer wg.Done()
+			ok, err := f(v)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if ok {
+				vsf = append(vsf, v)
+			}
+		}(v)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return vsf, nil
+}
@@ -7,6 +7,7 @@
 package main
 
 import (
+	"errors"
 	"strconv"
 	"testing"
 
@@ -123,3 +124,36 @@ func TestNotIn(t *testing.T) {
 		assert.Equal(t, tt.out, b, "TestNotIn "+strconv.Itoa(i+1)+" they should be equal")
 	}
 }
+
+func TestParallelFilterErr(t *testing.T) {
+	var tests = []struct {
+		inSlice      []string
+		inFilterFunc func(string) (bool, error)
+		out          []string
+		outErr       bool
+	}{
+		{
+			[]string{"4444", "55555", "0"},
+			func(s string) (bool, error) {
+				return len(s) == 5, nil
+			},
+			[]string{"55555"},
+			false,
+		}, {
+			[]string{"4444", "55555", "0"},
+			func(s string) (bool, error) {
+				if s == "0" {
+					return false, errors.New("failed")
+				}
+				return true, nil
+			},
+			nil,
+			true,
+		},
+	}
+	for i, tt := range tests {
+		b, err := parallelFilterErr(tt.inSlice, tt.inFilterFunc)
+		assert.Equal(t, tt.out, b, "test "+strconv.Itoa(i+1)+" they should be equal")
+		assert.Equal(t, tt.outErr, err != nil, "test "+strconv.Itoa(i+1)+" error should be equal")
+	}
+}
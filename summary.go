@@ -0,0 +1,156 @@
+// docker-unregstriy-untagger :- run summary
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// exit codes of the commands
+const (
+	exitSuccess        = 0
+	exitConfig         = 1
+	exitPartialFailure = 2
+	exitFailure        = 3
+	exitUsage          = 64
+)
+
+// runSummary counts what happened during one run over all repositories
+type runSummary struct {
+	sync.Mutex
+	Repositories int
+	Removed      int
+	Quarantined  int
+	Skipped      int
+	Reclaimable  int64
+	// Untagged is the size of manifests that only lose their tags, it is
+	// freed by a garbage-collection that deletes untagged manifests
+	Untagged     int64
+	Archived     int
+	ArchivedSize int64
+	DeleteMode   string
+	Failed       []string
+	// Stopped are the repositories the shutdown interrupted, they are no
+	// failures
+	Stopped     []string
+	Interrupted bool
+	Duration    time.Duration
+}
+
+func (s *runSummary) add(repo string, removed, quarantined int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.Repositories++
+	s.Removed += removed
+	s.Quarantined += quarantined
+	switch {
+	case errors.Is(err, errInterrupted):
+		s.Stopped = append(s.Stopped, repo)
+		sort.Strings(s.Stopped)
+	case err != nil:
+		s.Failed = append(s.Failed, repo)
+		sort.Strings(s.Failed)
+	}
+}
+
+// merge adds the summary of a registry to the combined summary of several
+// registries. A registry that failed as a whole counts as a failed repository.
+func (s *runSummary) merge(name string, other *runSummary, err error) {
+	s.Lock()
+	defer s.Unlock()
+	other.Lock()
+	defer other.Unlock()
+
+	s.Repositories += other.Repositories
+	s.Removed += other.Removed
+	s.Quarantined += other.Quarantined
+	s.Skipped += other.Skipped
+	s.Reclaimable += other.Reclaimable
+	s.Untagged += other.Untagged
+	s.Archived += other.Archived
+	s.ArchivedSize += other.ArchivedSize
+	s.Interrupted = s.Interrupted || other.Interrupted
+	for _, repo := range other.Failed {
+		s.Failed = append(s.Failed, name+"/"+repo)
+	}
+	for _, repo := range other.Stopped {
+		s.Stopped = append(s.Stopped, name+"/"+repo)
+	}
+	sort.Strings(s.Stopped)
+	if err != nil {
+		s.Repositories++
+		s.Failed = append(s.Failed, name)
+	}
+	sort.Strings(s.Failed)
+
+	if other.DeleteMode != "" {
+		if s.DeleteMode != "" {
+			s.DeleteMode += ","
+		}
+		s.DeleteMode += name + ":" + other.DeleteMode
+	}
+}
+
+func (s *runSummary) addReclaimable(size int64) {
+	s.Lock()
+	s.Reclaimable += size
+	s.Unlock()
+}
+
+func (s *runSummary) addUntagged(size int64) {
+	s.Lock()
+	s.Untagged += size
+	s.Unlock()
+}
+
+// addArchived counts an image exported before its removal
+func (s *runSummary) addArchived(size int64) {
+	s.Lock()
+	s.Archived++
+	s.ArchivedSize += size
+	s.Unlock()
+}
+
+// skip counts a repository that did not change since the last run
+func (s *runSummary) skip() {
+	s.Lock()
+	s.Repositories++
+	s.Skipped++
+	s.Unlock()
+}
+
+// exitCode distinguishes success, some failed repositories and a run where
+// every repository failed. An interrupted run is at most a partial failure,
+// repositories stopped by the shutdown do not count as failed.
+func (s *runSummary) exitCode() int {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case len(s.Failed) == 0 && (s.Interrupted || len(s.Stopped) != 0):
+		return exitPartialFailure
+	case len(s.Failed) == 0:
+		return exitSuccess
+	case len(s.Failed) < s.Repositories:
+		return exitPartialFailure
+	default:
+		return exitFailure
+	}
+}
+
+func (s *runSummary) String() string {
+	s.Lock()
+	defer s.Unlock()
+
+	return fmt.Sprintf("repositories=%d skipped=%d removed=%d quarantined=%d reclaimable=%s untagged=%s archived=%d (%s) failed=%v stopped=%v interrupted=%t deleteMode=%s duration=%s",
+		s.Repositories, s.Skipped, s.Removed, s.Quarantined, formatBytes(s.Reclaimable), formatBytes(s.Untagged), s.Archived, formatBytes(s.ArchivedSize), s.Failed, s.Stopped, s.Interrupted, s.DeleteMode, s.Duration)
+}
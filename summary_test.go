@@ -0,0 +1,67 @@
+// docker-unregstriy-untagger :- tests for the run summary
+// Copyright (c) 2017, Steffen Windoffer, Deutsche Telekom AG
+// Contact: opensource@telekom.de
+// This file is distributed under the conditions of the Apache2 license.
+// For details see the files LICENSE at the toplevel.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRunSummaryExitCode(t *testing.T) {
+	var tests = []struct {
+		inFailed []bool
+		out      int
+	}{
+		{[]bool{}, exitSuccess},
+		{[]bool{false, false}, exitSuccess},
+		{[]bool{false, true}, exitPartialFailure},
+		{[]bool{true, true}, exitFailure},
+	}
+	for _, tt := range tests {
+		s := &runSummary{}
+		for i, failed := range tt.inFailed {
+			var err error
+			if failed {
+				err = errors.New("failed")
+			}
+			s.add("repo"+string('a'+rune(i)), 1, 0, err)
+		}
+		if b := s.exitCode(); b != tt.out {
+			t.Errorf("exitCode() with %v => %d, want %d", tt.inFailed, b, tt.out)
+		}
+	}
+}
+
+func TestRunSummaryInterrupted(t *testing.T) {
+	s := &runSummary{Interrupted: true}
+	s.add("repo", 1, 0, nil)
+	if b := s.exitCode(); b != exitPartialFailure {
+		t.Errorf("exitCode() of interrupted run => %d, want %d", b, exitPartialFailure)
+	}
+}
+
+func TestRunSummaryStopped(t *testing.T) {
+	var tests = []struct {
+		inErrs []error
+		out    int
+	}{
+		{[]error{errInterrupted, fmt.Errorf("%w after removing %d tags", errInterrupted, 2)}, exitPartialFailure},
+		{[]error{nil, errInterrupted}, exitPartialFailure},
+		{[]error{errors.New("failed"), errInterrupted}, exitPartialFailure},
+		{[]error{errors.New("failed"), errors.New("failed")}, exitFailure},
+	}
+	for _, tt := range tests {
+		s := &runSummary{}
+		for i, err := range tt.inErrs {
+			s.add("repo"+string('a'+rune(i)), 1, 0, err)
+		}
+		if b := s.exitCode(); b != tt.out {
+			t.Errorf("exitCode() with %v => %d, want %d", tt.inErrs, b, tt.out)
+		}
+	}
+}